@@ -3,17 +3,39 @@ package main
 import (
 	"errors"
 	"io"
+	"math/rand"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
 )
 
 const (
 	// TODO(szpakas): move to config
 	ingressQueueSize = 1024 * 100
+
+	// nativeHistogramDefaultFactor is used for native histograms defined without bucket factor.
+	// It results in 8 buckets per power of two (schema 3).
+	nativeHistogramDefaultFactor = 1.1
+
+	// nativeHistogramMaxBuckets limits number of sparse buckets of single native histogram.
+	// Resolution is reduced when the limit is reached.
+	nativeHistogramMaxBuckets = 160
+
+	// nativeHistogramMinResetDuration is the minimal time after which native histogram
+	// reaching bucket limit is reset instead of reducing its resolution.
+	nativeHistogramMinResetDuration = time.Hour
+
+	// defaultLateSampleTolerance is the maximum age of timestamped samples aggregated by counters,
+	// histograms, summaries and sets. Older samples are dropped.
+	defaultLateSampleTolerance = 5 * time.Minute
+
+	// defaultSetWindow is a duration of windows in which distinct tokens of sets are counted.
+	defaultSetWindow = time.Minute
 )
 
 var (
@@ -42,6 +64,15 @@ type collector struct {
 	histograms   map[string]*UpdatingHistogram
 	histogramsMu sync.RWMutex
 
+	summaries   map[string]*UpdatingSummary
+	summariesMu sync.RWMutex
+
+	sets   map[string]*UpdatingSet
+	setsMu sync.RWMutex
+
+	// metadata holds help and unit of metrics sent by clients or configured
+	metadata *metadataStore
+
 	testHookProcessSampleDone func()
 
 	// quitCh is used to signal shutdown request
@@ -56,9 +87,16 @@ type collector struct {
 	metricQueueLength        prometheus.Gauge
 	metricProcessingDuration *prometheus.SummaryVec
 	metricExpiringDuration   *prometheus.SummaryVec
+	metricLateSamplesTotal   *prometheus.CounterVec
 
 	// expiryTime defines the duration for expiring metrics.
 	expiryTime time.Duration
+
+	// lateSampleTolerance defines the maximum age of aggregated timestamped samples.
+	lateSampleTolerance time.Duration
+
+	// setWindow defines the duration of windows in which distinct tokens of sets are counted.
+	setWindow time.Duration
 }
 
 func newCollector(et time.Duration) *collector {
@@ -67,11 +105,16 @@ func newCollector(et time.Duration) *collector {
 		counters:                  make(map[string]*UpdatingCounter),
 		gauges:                    make(map[string]*UpdatingGauge),
 		histograms:                make(map[string]*UpdatingHistogram),
+		summaries:                 make(map[string]*UpdatingSummary),
+		sets:                      make(map[string]*UpdatingSet),
+		metadata:                  newMetadataStore(nil),
 		testHookProcessSampleDone: func() {},
-		quitCh:          make(chan struct{}),
-		shutdownDownCh:  make(chan struct{}),
-		shutdownTimeout: time.Second,
-		expiryTime:      et,
+		quitCh:                    make(chan struct{}),
+		shutdownDownCh:            make(chan struct{}),
+		shutdownTimeout:           time.Second,
+		expiryTime:                et,
+		setWindow:                 defaultSetWindow,
+		lateSampleTolerance:       defaultLateSampleTolerance,
 
 		metricAppStart: prometheus.NewGauge(
 			prometheus.GaugeOpts{
@@ -108,6 +151,14 @@ func newCollector(et time.Duration) *collector {
 			},
 			[]string{"sampleKind"},
 		),
+
+		metricLateSamplesTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "app_collector_late_samples_total",
+				Help: "Number of timestamped samples dropped by the collector as observed too late.",
+			},
+			[]string{"sampleKind"},
+		),
 	}
 }
 
@@ -121,6 +172,7 @@ func (c *collector) Collect(ch chan<- prometheus.Metric) {
 	c.metricQueueLength.Collect(ch)
 	c.metricProcessingDuration.Collect(ch)
 	c.metricExpiringDuration.Collect(ch)
+	c.metricLateSamplesTotal.Collect(ch)
 
 	c.countersMu.RLock()
 	for _, m := range c.counters {
@@ -130,6 +182,10 @@ func (c *collector) Collect(ch chan<- prometheus.Metric) {
 
 	c.gaugesMu.RLock()
 	for _, m := range c.gauges {
+		if ts := m.Timestamp(); !ts.IsZero() {
+			ch <- prometheus.NewMetricWithTimestamp(ts, m.Gauge)
+			continue
+		}
 		m.Gauge.Collect(ch)
 	}
 	c.gaugesMu.RUnlock()
@@ -139,6 +195,20 @@ func (c *collector) Collect(ch chan<- prometheus.Metric) {
 		m.Histogram.Collect(ch)
 	}
 	c.histogramsMu.RUnlock()
+
+	c.summariesMu.RLock()
+	for _, m := range c.summaries {
+		m.Summary.Collect(ch)
+	}
+	c.summariesMu.RUnlock()
+
+	c.setsMu.RLock()
+	for _, m := range c.sets {
+		if m.Complete() {
+			m.Gauge.Collect(ch)
+		}
+	}
+	c.setsMu.RUnlock()
 }
 
 // Describe implements prometheus.Collector.
@@ -148,6 +218,7 @@ func (c *collector) Describe(ch chan<- *prometheus.Desc) {
 	c.metricQueueLength.Describe(ch)
 	c.metricProcessingDuration.Describe(ch)
 	c.metricExpiringDuration.Describe(ch)
+	c.metricLateSamplesTotal.Describe(ch)
 }
 
 func (c *collector) start() {
@@ -157,6 +228,7 @@ func (c *collector) start() {
 
 	go c.process()
 	go c.processExpiring()
+	go c.processSetWindows()
 }
 
 func (c *collector) stop() error {
@@ -199,6 +271,12 @@ func (c *collector) process() {
 
 			h = s.hash()
 
+			if c.isLate(s, tS) {
+				c.metricLateSamplesTotal.WithLabelValues(string(s.kind)).Inc()
+				c.sampleDone(s, tS)
+				continue
+			}
+
 			switch s.kind {
 			case sampleCounter:
 				c.countersMu.RLock()
@@ -219,7 +297,7 @@ func (c *collector) process() {
 					c.countersMu.Unlock()
 				}
 
-				m.Counter.Add(s.value)
+				m.Counter.Add(s.value * s.weight())
 				m.Touch()
 
 			case sampleGauge:
@@ -241,7 +319,21 @@ func (c *collector) process() {
 					c.gaugesMu.Unlock()
 				}
 
-				m.Gauge.Set(s.value)
+				if !s.timestamp.IsZero() && s.timestamp.Before(m.Timestamp()) {
+					// value observed later is already applied
+					c.metricLateSamplesTotal.WithLabelValues(string(s.kind)).Inc()
+					break
+				}
+
+				switch s.gaugeOp {
+				case gaugeOpAdd:
+					m.Gauge.Add(s.value)
+				case gaugeOpSub:
+					m.Gauge.Sub(s.value)
+				default:
+					m.Gauge.Set(s.value)
+				}
+				m.SetTimestamp(s.timestamp)
 				m.Touch()
 
 			case sampleHistogramLinear:
@@ -265,7 +357,62 @@ func (c *collector) process() {
 					c.histogramsMu.Unlock()
 				}
 
-				m.Histogram.Observe(s.value)
+				observeWeighted(m.Histogram, s)
+				m.Touch()
+
+			case sampleHistogramExponential:
+				c.histogramsMu.RLock()
+				m, found := c.histograms[string(h)]
+				c.histogramsMu.RUnlock()
+				if !found {
+					start, _ := strconv.ParseFloat(s.histogramDef[0], 64)
+					factor, _ := strconv.ParseFloat(s.histogramDef[1], 64)
+					count, _ := strconv.Atoi(s.histogramDef[2])
+					m = NewUpdatingHistogram(
+						prometheus.NewHistogram(
+							prometheus.HistogramOpts{
+								Name:        s.name,
+								Help:        "auto",
+								ConstLabels: s.labels,
+								Buckets:     prometheus.ExponentialBuckets(start, factor, count),
+							},
+						),
+					)
+					c.histogramsMu.Lock()
+					c.histograms[string(h)] = m
+					c.histogramsMu.Unlock()
+				}
+
+				observeWeighted(m.Histogram, s)
+				m.Touch()
+
+			case sampleHistogramNative:
+				c.histogramsMu.RLock()
+				m, found := c.histograms[string(h)]
+				c.histogramsMu.RUnlock()
+				if !found {
+					factor := nativeHistogramDefaultFactor
+					if len(s.histogramDef) > 0 {
+						factor, _ = strconv.ParseFloat(s.histogramDef[0], 64)
+					}
+					m = NewUpdatingHistogram(
+						prometheus.NewHistogram(
+							prometheus.HistogramOpts{
+								Name:                            s.name,
+								Help:                            "auto",
+								ConstLabels:                     s.labels,
+								NativeHistogramBucketFactor:     factor,
+								NativeHistogramMaxBucketNumber:  nativeHistogramMaxBuckets,
+								NativeHistogramMinResetDuration: nativeHistogramMinResetDuration,
+							},
+						),
+					)
+					c.histogramsMu.Lock()
+					c.histograms[string(h)] = m
+					c.histogramsMu.Unlock()
+				}
+
+				observeWeighted(m.Histogram, s)
 				m.Touch()
 
 			case sampleHistogram:
@@ -297,14 +444,88 @@ func (c *collector) process() {
 					c.histogramsMu.Unlock()
 				}
 
-				m.Histogram.Observe(s.value)
+				observeWeighted(m.Histogram, s)
+				m.Touch()
+
+			case sampleHistogramMerged:
+				c.histogramsMu.RLock()
+				m, found := c.histograms[string(h)]
+				c.histogramsMu.RUnlock()
+				if !found {
+					m = NewUpdatingHistogram(
+						newMergingHistogram(
+							prometheus.HistogramOpts{
+								Name:        s.name,
+								Help:        "auto",
+								ConstLabels: s.labels,
+							},
+							s.histogram.upperBounds,
+						),
+					)
+					c.histogramsMu.Lock()
+					c.histograms[string(h)] = m
+					c.histogramsMu.Unlock()
+				}
+
+				// kind is part of the hash, so entry always holds merging histogram
+				if !m.Histogram.(*mergingHistogram).merge(s.histogram) {
+					log.Debugf("Collector: histogram %s skipped, buckets differ from aggregated ones", s.name)
+					break
+				}
+				m.Touch()
+
+			case sampleSummary:
+				c.summariesMu.RLock()
+				m, found := c.summaries[string(h)]
+				c.summariesMu.RUnlock()
+				if !found {
+					objectives, maxAge := summaryOpts(s.summaryDef)
+					m = NewUpdatingSummary(
+						prometheus.NewSummary(
+							prometheus.SummaryOpts{
+								Name:        s.name,
+								Help:        "auto",
+								ConstLabels: s.labels,
+								Objectives:  objectives,
+								MaxAge:      maxAge,
+							},
+						),
+					)
+					c.summariesMu.Lock()
+					c.summaries[string(h)] = m
+					c.summariesMu.Unlock()
+				}
+
+				observeWeighted(m.Summary, s)
 				m.Touch()
-			}
 
-			c.testHookProcessSampleDone()
+			case sampleSet:
+				c.setsMu.RLock()
+				m, found := c.sets[string(h)]
+				c.setsMu.RUnlock()
+				if !found {
+					m = NewUpdatingSet(
+						prometheus.NewGauge(
+							prometheus.GaugeOpts{
+								Name:        s.name,
+								Help:        "auto",
+								ConstLabels: s.labels,
+							},
+						),
+					)
+					c.setsMu.Lock()
+					c.sets[string(h)] = m
+					c.setsMu.Unlock()
+				}
+
+				m.Add(s.token)
+				m.Touch()
+
+			case sampleMetadata:
+				c.metadata.update(s.name, s.meta)
+			}
 
-			c.metricProcessingDuration.WithLabelValues(string(s.kind)).
-				Observe(float64(time.Since(tS).Nanoseconds()))
+			c.sampleDone(s, tS)
 
 		case <-c.quitCh:
 			close(c.shutdownDownCh)
@@ -313,6 +534,37 @@ func (c *collector) process() {
 	}
 }
 
+// isLate checks if sample observed at given timestamp came too late to be aggregated.
+// Gauges are not checked, as they are exposed with the timestamp of the sample.
+func (c *collector) isLate(s *sample, now time.Time) bool {
+	return s.kind != sampleGauge && !s.timestamp.IsZero() && now.Sub(s.timestamp) > c.lateSampleTolerance
+}
+
+// sampleDone finishes processing of the sample started at tS.
+func (c *collector) sampleDone(s *sample, tS time.Time) {
+	c.testHookProcessSampleDone()
+
+	c.metricProcessingDuration.WithLabelValues(string(s.kind)).
+		Observe(float64(time.Since(tS).Nanoseconds()))
+
+	// metrics do not refer to the sample
+	s.release()
+}
+
+// observeWeighted observes sample value in histogram or summary as many times as many measurements it represents.
+// Fractional part of the sample weight is rounded randomly, so the total count stays unbiased.
+// Weight is bounded by sampleMinRate, so it's observed at most 1000 times.
+func observeWeighted(h prometheus.Observer, s *sample) {
+	w := s.weight()
+	n := int(w)
+	if rand.Float64() < w-float64(n) {
+		n++
+	}
+	for i := 0; i < n; i++ {
+		h.Observe(s.value)
+	}
+}
+
 func (c *collector) processExpiring() {
 	ticker := time.NewTicker(c.expiryTime)
 	for {
@@ -325,6 +577,27 @@ func (c *collector) processExpiring() {
 	}
 }
 
+// processSetWindows closes windows of all sets periodically.
+func (c *collector) processSetWindows() {
+	ticker := time.NewTicker(c.setWindow)
+	for {
+		select {
+		case <-ticker.C:
+			c.closeSetWindows()
+		case <-c.quitCh:
+			return
+		}
+	}
+}
+
+func (c *collector) closeSetWindows() {
+	c.setsMu.RLock()
+	for _, m := range c.sets {
+		m.CloseWindow()
+	}
+	c.setsMu.RUnlock()
+}
+
 func (c *collector) expire() {
 	now := time.Now()
 	var ts time.Time
@@ -361,4 +634,51 @@ func (c *collector) expire() {
 	c.histogramsMu.Unlock()
 	c.metricExpiringDuration.WithLabelValues("histogram").
 		Observe(float64(time.Since(ts).Nanoseconds()))
+
+	c.summariesMu.Lock()
+	ts = time.Now()
+	for k, m := range c.summaries {
+		if now.Sub(m.UpdatedAt) > c.expiryTime {
+			delete(c.summaries, k)
+		}
+	}
+	c.summariesMu.Unlock()
+	c.metricExpiringDuration.WithLabelValues("summary").
+		Observe(float64(time.Since(ts).Nanoseconds()))
+
+	c.setsMu.Lock()
+	ts = time.Now()
+	for k, m := range c.sets {
+		if now.Sub(m.UpdatedAt) > c.expiryTime {
+			delete(c.sets, k)
+		}
+	}
+	c.setsMu.Unlock()
+	c.metricExpiringDuration.WithLabelValues("set").
+		Observe(float64(time.Since(ts).Nanoseconds()))
+}
+
+// summaryDefaultObjectives are used for summaries defined without objectives.
+var summaryDefaultObjectives = map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001}
+
+// summaryOpts converts summary definition to objectives and max age.
+// Definition is already validated by the parser. Zero max age means default one.
+func summaryOpts(def []string) (map[float64]float64, time.Duration) {
+	var (
+		objectives = make(map[float64]float64)
+		maxAge     time.Duration
+	)
+	for _, d := range def {
+		if i := strings.Index(d, sampleParserSummaryObjectiveSeparator); i >= 0 {
+			quantile, _ := strconv.ParseFloat(d[:i], 64)
+			epsilon, _ := strconv.ParseFloat(d[i+1:], 64)
+			objectives[quantile] = epsilon
+			continue
+		}
+		maxAge, _ = time.ParseDuration(d)
+	}
+	if len(objectives) == 0 {
+		objectives = summaryDefaultObjectives
+	}
+	return objectives, maxAge
 }
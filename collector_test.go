@@ -21,6 +21,7 @@ func Test_Collector_New(t *testing.T) {
 	a.NotNil(t, c.counters)
 	a.NotNil(t, c.gauges)
 	a.NotNil(t, c.histograms)
+	a.NotNil(t, c.summaries)
 	a.Equal(t, c.expiryTime, defaultExpiryTime)
 }
 
@@ -273,6 +274,118 @@ func Test_Collector_Process_Success_HistogramLinear(t *testing.T) {
 	a.Equal(t, float64(14), b.GetUpperBound())
 }
 
+func Test_Collector_Process_Success_HistogramExponential(t *testing.T) {
+	s1 := sample{
+		name: "name_of_1_metric_seconds", kind: sampleHistogramExponential,
+		labels:       map[string]string{"labelA": "labelValueA"},
+		histogramDef: []string{"0.001", "2", "16"},
+	}
+	s2 := s1
+
+	s1.value = 0.003
+	s2.value = 0.5
+
+	defer thInitSampleHasher(hashMD5)()
+	c := newCollector(defaultExpiryTime)
+	c.ingressCh <- &s1
+	c.ingressCh <- &s2
+
+	thCollectorProcessSynchronise(t, c)
+
+	var mm dto.Metric
+	m := c.histograms[string(s1.hash())]
+	m.Histogram.Write(&mm)
+	a.Equal(t, uint64(2), mm.Histogram.GetSampleCount())
+	if !a.Len(t, mm.Histogram.GetBucket(), 16) {
+		t.FailNow()
+	}
+
+	// 0.004 is the first bucket holding 0.003
+	b := mm.Histogram.GetBucket()[2]
+	a.Equal(t, uint64(1), b.GetCumulativeCount())
+	a.Equal(t, 0.004, b.GetUpperBound())
+}
+
+func Test_Collector_Process_Success_HistogramNative(t *testing.T) {
+	s1 := sample{
+		name: "name_of_1_metric_seconds", kind: sampleHistogramNative,
+		labels: map[string]string{"labelA": "labelValueA"},
+	}
+	s2 := s1
+	s2.histogramDef = []string{"2"} // ignored, the first sample defines the histogram
+
+	s1.value = 1.5
+	s2.value = 3
+
+	defer thInitSampleHasher(hashMD5)()
+	c := newCollector(defaultExpiryTime)
+	c.ingressCh <- &s1
+	c.ingressCh <- &s2
+
+	thCollectorProcessSynchronise(t, c)
+
+	var mm dto.Metric
+	m := c.histograms[string(s1.hash())]
+	m.Histogram.Write(&mm)
+	a.Equal(t, uint64(2), mm.Histogram.GetSampleCount())
+	a.Equal(t, float64(4.5), mm.Histogram.GetSampleSum())
+	// default factor 1.1 results in 8 buckets per power of two
+	a.Equal(t, int32(3), mm.Histogram.GetSchema())
+	a.Empty(t, mm.Histogram.GetBucket())
+	a.Len(t, mm.Histogram.GetPositiveSpan(), 2)
+	a.Equal(t, []int64{1, 0}, mm.Histogram.GetPositiveDelta())
+}
+
+func Test_Collector_Process_Success_Summary(t *testing.T) {
+	summary := func(v float64) *sample {
+		return &sample{
+			name: "name_of_1_metric_seconds", kind: sampleSummary,
+			labels:     map[string]string{"labelA": "labelValueA"},
+			value:      v,
+			summaryDef: []string{"0.5:0.05", "0.9:0.01", "1m"},
+		}
+	}
+
+	defer thInitSampleHasher(hashMD5)()
+	c := newCollector(defaultExpiryTime)
+	var samples []*sample
+	for i := 1; i <= 100; i++ {
+		samples = append(samples, summary(float64(i)))
+	}
+	thCollectorProcessPopulate(c, samples)
+	thCollectorProcessSynchronise(t, c)
+
+	var mm dto.Metric
+	c.summaries[string(summary(0).hash())].Summary.Write(&mm)
+	a.Equal(t, uint64(100), mm.Summary.GetSampleCount())
+	a.Equal(t, float64(5050), mm.Summary.GetSampleSum())
+	if a.Len(t, mm.Summary.GetQuantile(), 2) {
+		a.Equal(t, 0.5, mm.Summary.GetQuantile()[0].GetQuantile())
+		a.InDelta(t, 50, mm.Summary.GetQuantile()[0].GetValue(), 5)
+		a.Equal(t, 0.9, mm.Summary.GetQuantile()[1].GetQuantile())
+		a.InDelta(t, 90, mm.Summary.GetQuantile()[1].GetValue(), 1)
+	}
+}
+
+func Test_SummaryOpts(t *testing.T) {
+	tests := map[string]struct {
+		def           []string
+		expObjectives map[float64]float64
+		expMaxAge     time.Duration
+	}{
+		"objectives and max age": {[]string{"0.5:0.05", "0.99:0.001", "5m"}, map[float64]float64{0.5: 0.05, 0.99: 0.001}, 5 * time.Minute},
+		"objectives only":        {[]string{"0.75:0.01"}, map[float64]float64{0.75: 0.01}, 0},
+		"max age only":           {[]string{"30s"}, summaryDefaultObjectives, 30 * time.Second},
+		"empty":                  {nil, summaryDefaultObjectives, 0},
+	}
+
+	for sym, tc := range tests {
+		objectives, maxAge := summaryOpts(tc.def)
+		a.Equal(t, tc.expObjectives, objectives, sym)
+		a.Equal(t, tc.expMaxAge, maxAge, sym)
+	}
+}
+
 func Test_Collector_Collect_NoMetric(t *testing.T) {
 	c := newCollector(defaultExpiryTime)
 	metricCh := make(chan prometheus.Metric, 2048)
@@ -298,6 +411,11 @@ func Test_Collector_Collect_MetricFromSamples(t *testing.T) {
 	c.gauges["g1"] = NewUpdatingGauge(prometheus.NewGauge(prometheus.GaugeOpts{Name: "gauge_A", Help: "auto"}))
 	c.gauges["g2"] = NewUpdatingGauge(prometheus.NewGauge(prometheus.GaugeOpts{Name: "gauge_B", Help: "auto"}))
 	c.histograms["hl1"] = NewUpdatingHistogram(prometheus.NewHistogram(prometheus.HistogramOpts{Name: "histLinear_A", Help: "auto"}))
+	c.summaries["s1"] = NewUpdatingSummary(prometheus.NewSummary(prometheus.SummaryOpts{Name: "summary_A", Help: "auto"}))
+	c.sets["u1"] = NewUpdatingSet(prometheus.NewGauge(prometheus.GaugeOpts{Name: "set_A", Help: "auto"}))
+	c.sets["u1"].CloseWindow()
+	// not exposed before the first window is closed
+	c.sets["u2"] = NewUpdatingSet(prometheus.NewGauge(prometheus.GaugeOpts{Name: "set_B", Help: "auto"}))
 
 	expDescMap := make(map[string]prometheus.Desc)
 	descHash := func(d *prometheus.Desc) []byte {
@@ -312,6 +430,8 @@ func Test_Collector_Collect_MetricFromSamples(t *testing.T) {
 	addDesc(expDescMap, c.gauges["g1"].Gauge)
 	addDesc(expDescMap, c.gauges["g2"].Gauge)
 	addDesc(expDescMap, c.histograms["hl1"].Histogram)
+	addDesc(expDescMap, c.summaries["s1"].Summary)
+	addDesc(expDescMap, c.sets["u1"].Gauge)
 	addDesc(expDescMap, c.metricAppStart)
 	addDesc(expDescMap, c.metricAppDuration)
 	addDesc(expDescMap, c.metricQueueLength)
@@ -353,3 +473,231 @@ func Test_Collector_Expire(t *testing.T) {
 	a.Nil(t, c.counters[k])
 	a.Equal(t, l-1, len(c.counters))
 }
+
+func Test_Collector_Expire_Summary(t *testing.T) {
+	c := newCollector(defaultExpiryTime)
+	c.summaries["s1"] = NewUpdatingSummary(prometheus.NewSummary(prometheus.SummaryOpts{Name: "summary_A", Help: "auto"}))
+	c.summaries["s2"] = NewUpdatingSummary(prometheus.NewSummary(prometheus.SummaryOpts{Name: "summary_B", Help: "auto"}))
+	c.summaries["s1"].UpdatedAt = time.Now().Add(-48 * time.Hour)
+
+	c.expire()
+
+	a.Nil(t, c.summaries["s1"])
+	a.NotNil(t, c.summaries["s2"])
+}
+
+func Test_Collector_Expire_Set(t *testing.T) {
+	c := newCollector(defaultExpiryTime)
+	c.sets["u1"] = NewUpdatingSet(prometheus.NewGauge(prometheus.GaugeOpts{Name: "set_A", Help: "auto"}))
+	c.sets["u2"] = NewUpdatingSet(prometheus.NewGauge(prometheus.GaugeOpts{Name: "set_B", Help: "auto"}))
+	c.sets["u1"].UpdatedAt = time.Now().Add(-48 * time.Hour)
+
+	c.expire()
+
+	a.Nil(t, c.sets["u1"])
+	a.NotNil(t, c.sets["u2"])
+}
+
+func Test_Collector_Process_Success_Set(t *testing.T) {
+	set := func(token string) *sample {
+		return &sample{name: "users", kind: sampleSet, labels: map[string]string{"labelA": "labelValueA"}, token: token}
+	}
+
+	defer thInitSampleHasher(hashMD5)()
+	c := newCollector(defaultExpiryTime)
+	thCollectorProcessPopulate(c, []*sample{set("john"), set("jane"), set("john")})
+	thCollectorProcessSynchronise(t, c)
+
+	m := c.sets[string(set("").hash())]
+	if !a.NotNil(t, m) {
+		t.FailNow()
+	}
+	a.False(t, m.Complete())
+
+	var mm dto.Metric
+	m.CloseWindow()
+	m.Gauge.Write(&mm)
+	a.True(t, m.Complete())
+	a.Equal(t, float64(2), mm.Gauge.GetValue())
+
+	// the next window starts empty
+	m.Add("joe")
+	c.closeSetWindows()
+	m.Gauge.Write(&mm)
+	a.Equal(t, float64(1), mm.Gauge.GetValue())
+}
+
+func Test_Collector_Process_LateSamplesDropped(t *testing.T) {
+	counter := func(v float64, ts time.Time) *sample {
+		return &sample{name: "name_of_1_metric_total", kind: sampleCounter, labels: map[string]string{}, value: v, timestamp: ts}
+	}
+
+	defer thInitSampleHasher(hashMD5)()
+	c := newCollector(defaultExpiryTime)
+	thCollectorProcessPopulate(c, []*sample{
+		counter(1, time.Time{}),
+		counter(2, time.Now().Add(-time.Minute)),
+		counter(4, time.Now().Add(-defaultLateSampleTolerance-time.Minute)),
+	})
+	thCollectorProcessSynchronise(t, c)
+
+	var mm dto.Metric
+	c.counters[string(counter(0, time.Time{}).hash())].Counter.Write(&mm)
+	a.Equal(t, float64(3), mm.Counter.GetValue())
+
+	c.metricLateSamplesTotal.WithLabelValues(string(sampleCounter)).Write(&mm)
+	a.Equal(t, float64(1), mm.Counter.GetValue())
+}
+
+func Test_Collector_Process_Success_GaugeTimestamp(t *testing.T) {
+	gauge := func(v float64, ts time.Time) *sample {
+		return &sample{name: "name_of_3_metric", kind: sampleGauge, labels: map[string]string{}, value: v, timestamp: ts}
+	}
+	ts := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+
+	defer thInitSampleHasher(hashMD5)()
+	c := newCollector(defaultExpiryTime)
+	thCollectorProcessPopulate(c, []*sample{
+		gauge(1, ts.Add(-time.Second)),
+		gauge(2, ts),
+		// older than the value already set
+		gauge(3, ts.Add(-time.Second)),
+	})
+	thCollectorProcessSynchronise(t, c)
+
+	m := c.gauges[string(gauge(0, time.Time{}).hash())]
+	a.Equal(t, ts, m.Timestamp())
+
+	metricCh := make(chan prometheus.Metric, 2048)
+	c.Collect(metricCh)
+	close(metricCh)
+
+	var found bool
+	for me := range metricCh {
+		if me.Desc() != m.Gauge.Desc() {
+			continue
+		}
+		found = true
+
+		var mm dto.Metric
+		me.Write(&mm)
+		a.Equal(t, float64(2), mm.Gauge.GetValue())
+		a.Equal(t, ts.UnixMilli(), mm.GetTimestampMs())
+	}
+	a.True(t, found)
+
+	// value without timestamp is exposed without one
+	m.SetTimestamp(time.Time{})
+	a.True(t, m.Timestamp().IsZero())
+}
+
+func Test_Collector_Process_Success_Metadata(t *testing.T) {
+	defer thInitSampleHasher(hashMD5)()
+	c := newCollector(defaultExpiryTime)
+	thCollectorProcessPopulate(c, []*sample{
+		{name: "name_of_1_metric_seconds", kind: sampleMetadata, labels: map[string]string{}, meta: metricMetadata{Help: "Duration of requests."}},
+		{name: "name_of_1_metric_seconds", kind: sampleMetadata, labels: map[string]string{}, meta: metricMetadata{Unit: "seconds"}},
+	})
+	thCollectorProcessSynchronise(t, c)
+
+	md, found := c.metadata.get("name_of_1_metric_seconds")
+	a.True(t, found)
+	a.Equal(t, metricMetadata{Help: "Duration of requests.", Unit: "seconds"}, md)
+	a.Empty(t, c.gauges)
+}
+
+func Test_Collector_Process_Success_GaugeOps(t *testing.T) {
+	gauge := func(v float64, op gaugeOp) *sample {
+		return &sample{name: "name_of_3_metric", kind: sampleGauge, labels: map[string]string{}, value: v, gaugeOp: op}
+	}
+
+	defer thInitSampleHasher(hashMD5)()
+	c := newCollector(defaultExpiryTime)
+	thCollectorProcessPopulate(c, []*sample{
+		gauge(10, gaugeOpSet),
+		gauge(5, gaugeOpAdd),
+		gauge(2.5, gaugeOpSub),
+	})
+	thCollectorProcessSynchronise(t, c)
+
+	var mm dto.Metric
+	c.gauges[string(gauge(0, gaugeOpSet).hash())].Gauge.Write(&mm)
+	a.Equal(t, 12.5, mm.Gauge.GetValue())
+}
+
+func Test_Collector_Process_Success_SampleRate(t *testing.T) {
+	counter := &sample{
+		name: "name_of_2_metric_total", kind: sampleCounter,
+		labels: map[string]string{}, value: 3, sampleRate: 0.1,
+	}
+	histogram := &sample{
+		name: "name_of_1_metric_seconds", kind: sampleHistogram,
+		labels: map[string]string{}, value: 0.3, sampleRate: 0.25,
+	}
+
+	defer thInitSampleHasher(hashMD5)()
+	c := newCollector(defaultExpiryTime)
+	thCollectorProcessPopulate(c, []*sample{counter, histogram})
+	thCollectorProcessSynchronise(t, c)
+
+	var mm dto.Metric
+	c.counters[string(counter.hash())].Counter.Write(&mm)
+	a.InDelta(t, 30, mm.Counter.GetValue(), 1e-9)
+
+	c.histograms[string(histogram.hash())].Histogram.Write(&mm)
+	a.Equal(t, uint64(4), mm.Histogram.GetSampleCount())
+	a.InDelta(t, 1.2, mm.Histogram.GetSampleSum(), 1e-9)
+}
+
+func Test_ObserveWeighted_Unbiased(t *testing.T) {
+	h := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test", Help: "test"})
+	s := &sample{value: 1, sampleRate: 0.3}
+
+	n := 10000
+	for i := 0; i < n; i++ {
+		observeWeighted(h, s)
+	}
+
+	var mm dto.Metric
+	h.Write(&mm)
+	// each observation represents 3.33 measurements
+	a.InEpsilon(t, float64(n)/0.3, float64(mm.Histogram.GetSampleCount()), 0.02)
+}
+
+func Test_ObserveWeighted_Capped(t *testing.T) {
+	h := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test", Help: "test"})
+	observeWeighted(h, &sample{value: 1, sampleRate: 1e-300})
+
+	var mm dto.Metric
+	h.Write(&mm)
+	a.Equal(t, uint64(1/sampleMinRate), mm.Histogram.GetSampleCount())
+}
+
+func Test_Collector_Process_Success_HistogramMerged(t *testing.T) {
+	histogram := func(counts []uint64, count uint64, sum float64) *sample {
+		return &sample{
+			name: "name_of_1_metric_seconds", kind: sampleHistogramMerged, labels: map[string]string{},
+			histogram: &histogramData{upperBounds: []float64{0.1, 1}, counts: counts, count: count, sum: sum},
+		}
+	}
+	mismatched := histogram([]uint64{1}, 1, 0.5)
+	mismatched.histogram.upperBounds = []float64{0.5}
+
+	defer thInitSampleHasher(hashMD5)()
+	c := newCollector(defaultExpiryTime)
+	thCollectorProcessPopulate(c, []*sample{
+		histogram([]uint64{1, 2}, 3, 2.5),
+		histogram([]uint64{0, 4}, 4, 1.5),
+		mismatched,
+	})
+	thCollectorProcessSynchronise(t, c)
+
+	var mm dto.Metric
+	c.histograms[string(mismatched.hash())].Histogram.Write(&mm)
+	a.Equal(t, uint64(7), mm.Histogram.GetSampleCount())
+	a.Equal(t, 4.0, mm.Histogram.GetSampleSum())
+	if a.Len(t, mm.Histogram.Bucket, 2) {
+		a.Equal(t, uint64(1), mm.Histogram.Bucket[0].GetCumulativeCount())
+		a.Equal(t, uint64(6), mm.Histogram.Bucket[1].GetCumulativeCount())
+	}
+}
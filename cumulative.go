@@ -0,0 +1,101 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// cumulativeTracker converts cumulative values reported by clients to increases since the previous report,
+// so they can be aggregated with values of other clients.
+// Series are recognized by key. Change of the series start time or decrease of the value is treated as reset.
+type cumulativeTracker struct {
+	mu     sync.Mutex
+	series map[string]*cumulativeSeries
+
+	// expiryTime defines the duration after which not reported series are forgotten.
+	expiryTime time.Duration
+	expiredAt  time.Time
+}
+
+// cumulativeSeries is the last reported state of the series.
+type cumulativeSeries struct {
+	start     uint64
+	value     float64
+	histogram *histogramData
+	updatedAt time.Time
+}
+
+func newCumulativeTracker(expiryTime time.Duration) *cumulativeTracker {
+	return &cumulativeTracker{
+		series:     make(map[string]*cumulativeSeries),
+		expiryTime: expiryTime,
+		expiredAt:  time.Now(),
+	}
+}
+
+// cumulativeKey returns key of the series with given hash reported by single client.
+// Series with the same labels reported by distinct clients, e.g. processes started at different times,
+// are tracked separately, so their values are not mistaken for resets of each other.
+func cumulativeKey(hash []byte, client string) string {
+	return string(hash) + "/" + client
+}
+
+// counterDelta returns increase of the counter since the previous report of the series.
+// Whole value is returned for the first report and after reset.
+func (t *cumulativeTracker) counterDelta(key string, start uint64, value float64) float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	prev := t.swap(key, &cumulativeSeries{start: start, value: value})
+	if prev == nil || prev.start != start || value < prev.value {
+		return value
+	}
+	return value - prev.value
+}
+
+// histogramDelta returns observations added to the histogram since the previous report of the series.
+// Whole histogram is returned for the first report, after reset and when buckets were changed.
+func (t *cumulativeTracker) histogramDelta(key string, start uint64, d *histogramData) *histogramData {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	prev := t.swap(key, &cumulativeSeries{start: start, histogram: d})
+	if prev == nil || prev.histogram == nil || prev.start != start || d.count < prev.histogram.count ||
+		len(d.upperBounds) != len(prev.histogram.upperBounds) {
+		return d
+	}
+
+	delta := &histogramData{
+		upperBounds: d.upperBounds,
+		counts:      make([]uint64, len(d.counts)),
+		count:       d.count - prev.histogram.count,
+		sum:         d.sum - prev.histogram.sum,
+	}
+	for i, c := range d.counts {
+		if d.upperBounds[i] != prev.histogram.upperBounds[i] || c < prev.histogram.counts[i] {
+			return d
+		}
+		delta.counts[i] = c - prev.histogram.counts[i]
+	}
+	return delta
+}
+
+// swap stores current state of the series and returns the previous one.
+// Series not reported within expiry time are removed on the way.
+// Must be called with mu held.
+func (t *cumulativeTracker) swap(key string, cur *cumulativeSeries) *cumulativeSeries {
+	now := time.Now()
+	if now.Sub(t.expiredAt) > t.expiryTime {
+		for k, s := range t.series {
+			if now.Sub(s.updatedAt) > t.expiryTime {
+				delete(t.series, k)
+			}
+		}
+		t.expiredAt = now
+	}
+
+	cur.updatedAt = now
+	prev := t.series[key]
+	t.series[key] = cur
+	return prev
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	a "github.com/stretchr/testify/assert"
+)
+
+func Test_CumulativeTracker_CounterDelta(t *testing.T) {
+	tr := newCumulativeTracker(time.Hour)
+
+	a.Equal(t, 5.0, tr.counterDelta("a", 100, 5), "first report")
+	a.Equal(t, 3.0, tr.counterDelta("a", 100, 8), "increase")
+	a.Equal(t, 0.0, tr.counterDelta("a", 100, 8), "no change")
+	a.Equal(t, 2.0, tr.counterDelta("a", 100, 2), "decrease is reset")
+	a.Equal(t, 4.0, tr.counterDelta("a", 200, 4), "new start time is reset")
+	a.Equal(t, 7.0, tr.counterDelta("b", 100, 7), "other series")
+}
+
+func Test_CumulativeTracker_HistogramDelta(t *testing.T) {
+	tr := newCumulativeTracker(time.Hour)
+	histogram := func(bounds []float64, counts []uint64, count uint64, sum float64) *histogramData {
+		return &histogramData{upperBounds: bounds, counts: counts, count: count, sum: sum}
+	}
+
+	first := histogram([]float64{1, 2}, []uint64{1, 2}, 3, 4)
+	a.Equal(t, first, tr.histogramDelta("a", 100, first), "first report")
+
+	a.Equal(t,
+		histogram([]float64{1, 2}, []uint64{1, 1}, 2, 3),
+		tr.histogramDelta("a", 100, histogram([]float64{1, 2}, []uint64{2, 3}, 5, 7)),
+		"increase",
+	)
+
+	reset := histogram([]float64{1, 2}, []uint64{1, 1}, 1, 0.5)
+	a.Equal(t, reset, tr.histogramDelta("a", 100, reset), "decrease is reset")
+
+	rebucketed := histogram([]float64{1, 5}, []uint64{1, 2}, 2, 4)
+	a.Equal(t, rebucketed, tr.histogramDelta("a", 100, rebucketed), "changed buckets")
+}
+
+func Test_CumulativeTracker_Expire(t *testing.T) {
+	tr := newCumulativeTracker(time.Millisecond)
+
+	tr.counterDelta("a", 100, 5)
+	time.Sleep(5 * time.Millisecond)
+	tr.counterDelta("b", 100, 5)
+
+	_, found := tr.series["a"]
+	a.False(t, found)
+	a.Len(t, tr.series, 1)
+}
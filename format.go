@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// lineParser converts consecutive lines of a single batch to samples.
+// Implementation may keep state of the batch between lines.
+type lineParser interface {
+	// parseLine converts single line (without new-line character) to samples and appends them to out.
+	// Lines not holding valid samples are skipped. Parser may explain why the line was skipped
+	// with returned error, preferably *parseError.
+	parseLine(line string, out []*sample) ([]*sample, error)
+}
+
+// byteLineParser is implemented by line parsers able to parse line held in a reused buffer.
+// Such parsers get lines without copying them, so they must copy any part of the line kept in samples.
+type byteLineParser interface {
+	// parseLineBytes works the same way as lineParser.parseLine.
+	parseLineBytes(line []byte, out []*sample) ([]*sample, error)
+}
+
+// sampleFormat is a transport (text) representation of samples accepted by listeners.
+type sampleFormat struct {
+	name string
+
+	// newLineParser creates parser for a new batch of lines.
+	// It's set only for line based formats, which can be streamed (e.g. over TCP).
+	newLineParser func() lineParser
+
+	// parse converts whole batch (e.g. UDP packet or HTTP request body) to samples.
+	parse func(r io.Reader) ([]*sample, error)
+
+	// parseFrom works the same way as parse, but keeps state of cumulative values separately for each sender
+	// (e.g. address of HTTP client), so series with the same labels pushed by distinct senders are not mixed up.
+	// It's set only for formats converting cumulative values without start time, parse is used otherwise.
+	parseFrom func(r io.Reader, sender string) ([]*sample, error)
+
+	// parseBytes converts whole batch held in memory (e.g. UDP packet) to samples.
+	// Samples can not refer to b, as it's reused for the next batch.
+	// It's set only for formats able to parse batch without copying it, parse is used otherwise.
+	parseBytes func(b []byte) ([]*sample, error)
+}
+
+// newLineFormat creates line based format.
+func newLineFormat(name string, newLineParser func() lineParser) *sampleFormat {
+	return &sampleFormat{
+		name:          name,
+		newLineParser: newLineParser,
+		parse: func(r io.Reader) ([]*sample, error) {
+			return parseLines(r, newLineParser())
+		},
+		parseBytes: func(b []byte) ([]*sample, error) {
+			return parseLinesBytes(b, newLineParser())
+		},
+	}
+}
+
+var (
+	// formatNative is the format described in README.
+	formatNative = newNativeFormat()
+
+	// formatStatsD is plain StatsD format.
+	formatStatsD = newLineFormat("statsd", func() lineParser { return statsDLineParser{} })
+
+	// sampleFormats holds all formats which can be selected in config.
+	sampleFormats = map[string]*sampleFormat{
+		formatNative.name: formatNative,
+		formatStatsD.name: formatStatsD,
+
+		formatPrometheus.name: formatPrometheus,
+		formatJSON.name:       formatJSON,
+	}
+)
+
+// registerSampleFormat makes format available for selection in config.
+// Formats depending on config are registered on start, before listeners are created.
+func registerSampleFormat(f *sampleFormat) {
+	sampleFormats[f.name] = f
+}
+
+// lookupSampleFormat returns format registered under name.
+func lookupSampleFormat(name string) (*sampleFormat, error) {
+	f, found := sampleFormats[name]
+	if !found {
+		var names []string
+		for n := range sampleFormats {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, errors.Errorf("unknown sample format %q, valid formats: %s", name, strings.Join(names, ", "))
+	}
+	return f, nil
+}
+
+// parseLines reads all lines and converts them to samples with p.
+// Invalid lines are skipped and reported with batchErrors. Other error is returned only when reading fails.
+// Samples parsed up to that point are returned with errors.
+func parseLines(r io.Reader, p lineParser) ([]*sample, error) {
+	var (
+		out     []*sample
+		invalid batchErrors
+		lineNo  int
+		err     error
+	)
+
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		lineNo++
+		if out, err = parseLineWith(p, scanner.Bytes(), out); err != nil {
+			invalid = append(invalid, lineError(err, lineNo, scanner.Text()))
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return out, err
+	}
+	if len(invalid) > 0 {
+		return out, invalid
+	}
+	return out, nil
+}
+
+// parseLinesBytes converts lines of the batch held in memory with p, the same way parseLines does.
+// Lines are split the same way as by bufio.ScanLines, but without copying them.
+func parseLinesBytes(b []byte, p lineParser) ([]*sample, error) {
+	var (
+		out     []*sample
+		invalid batchErrors
+		lineNo  int
+		err     error
+	)
+
+	for len(b) > 0 {
+		line := b
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			line, b = b[:i], b[i+1:]
+		} else {
+			b = nil
+		}
+		line = bytes.TrimSuffix(line, []byte{'\r'})
+
+		lineNo++
+		if out, err = parseLineWith(p, line, out); err != nil {
+			invalid = append(invalid, lineError(err, lineNo, string(line)))
+		}
+	}
+
+	if len(invalid) > 0 {
+		return out, invalid
+	}
+	return out, nil
+}
+
+// parseLineWith passes line to p, without copying it if p is a byteLineParser.
+func parseLineWith(p lineParser, line []byte, out []*sample) ([]*sample, error) {
+	if bp, ok := p.(byteLineParser); ok {
+		return bp.parseLineBytes(line, out)
+	}
+	return p.parseLine(string(line), out)
+}
+
+// parseErrorReason is a category of invalid element. It's used as label of parse errors metric.
+type parseErrorReason string
+
+const (
+	parseErrorMalformed             parseErrorReason = "malformed"
+	parseErrorBadName               parseErrorReason = "bad_name"
+	parseErrorBadKind               parseErrorReason = "bad_kind"
+	parseErrorBadLabel              parseErrorReason = "bad_label"
+	parseErrorBadValue              parseErrorReason = "bad_value"
+	parseErrorBadHistogramDef       parseErrorReason = "bad_histogram_def"
+	parseErrorBadSummaryDef         parseErrorReason = "bad_summary_def"
+	parseErrorBadSampleRate         parseErrorReason = "bad_sample_rate"
+	parseErrorBadTimestamp          parseErrorReason = "bad_timestamp"
+	parseErrorMisplacedSharedLabels parseErrorReason = "misplaced_shared_labels"
+
+	// parseErrorMaxTextLen limits length of the offending text kept in parse error.
+	parseErrorMaxTextLen = 256
+)
+
+// parseError describes single invalid element of the batch.
+type parseError struct {
+	// Index is a position of the element in the batch, starting from 0.
+	Index int `json:"index"`
+
+	// Line is a number of the line holding the element, starting from 1.
+	// It's set only by line based formats.
+	Line int `json:"line,omitempty"`
+
+	Reason parseErrorReason `json:"reason"`
+
+	// Message describes why the element is invalid.
+	Message string `json:"error"`
+
+	// Text is the offending line, truncated to parseErrorMaxTextLen bytes.
+	// It's set only by line based formats.
+	Text string `json:"text,omitempty"`
+}
+
+// newParseError creates parse error with message formatted according to format specifier.
+// Position of the element is filled by the caller aware of the batch.
+func newParseError(reason parseErrorReason, format string, args ...interface{}) *parseError {
+	return &parseError{Reason: reason, Message: fmt.Sprintf(format, args...)}
+}
+
+// Error implements error.
+func (e *parseError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("line %d: %s: %s: %q", e.Line, e.Reason, e.Message, e.Text)
+	}
+	return fmt.Sprintf("element %d: %s: %s", e.Index, e.Reason, e.Message)
+}
+
+// lineError converts error returned by line parser to parse error of the line.
+func lineError(err error, lineNo int, text string) *parseError {
+	pe, ok := err.(*parseError)
+	if !ok {
+		pe = newParseError(parseErrorMalformed, "%s", err)
+	}
+	if len(text) > parseErrorMaxTextLen {
+		text = text[:parseErrorMaxTextLen]
+	}
+	pe.Index, pe.Line, pe.Text = lineNo-1, lineNo, text
+	return pe
+}
+
+// batchErrors is returned by parse when some elements of the batch are invalid.
+// Valid elements are converted to samples and returned along with it.
+type batchErrors []*parseError
+
+// Error implements error.
+func (e batchErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, pe := range e {
+		msgs = append(msgs, pe.Error())
+	}
+	return fmt.Sprintf("%d invalid elements: %s", len(e), strings.Join(msgs, "; "))
+}
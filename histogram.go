@@ -0,0 +1,130 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// histogramData holds histogram observations aggregated by the client, e.g. pushed in Prometheus text format.
+type histogramData struct {
+	// upperBounds are sorted upper bounds of the buckets, without +Inf bucket.
+	upperBounds []float64
+
+	// counts are cumulative counts of observations for upperBounds.
+	counts []uint64
+
+	count uint64
+	sum   float64
+}
+
+// mergingHistogram is a histogram built by merging aggregated observations bucket by bucket.
+// It implements prometheus.Histogram, so it's stored and exported the same way as other histograms.
+// Buckets are fixed with the first merged data.
+type mergingHistogram struct {
+	desc *prometheus.Desc
+
+	mu   sync.Mutex
+	data histogramData
+}
+
+// newMergingHistogram creates empty histogram with given bucket upper bounds.
+// Buckets in opts are ignored.
+func newMergingHistogram(opts prometheus.HistogramOpts, upperBounds []float64) *mergingHistogram {
+	return &mergingHistogram{
+		desc: prometheus.NewDesc(prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name), opts.Help, nil, opts.ConstLabels),
+		data: histogramData{
+			upperBounds: upperBounds,
+			counts:      make([]uint64, len(upperBounds)),
+		},
+	}
+}
+
+// merge adds observations from d to the histogram.
+// Returns false and leaves histogram untouched if buckets of d differ from histogram ones.
+func (h *mergingHistogram) merge(d *histogramData) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(d.upperBounds) != len(h.data.upperBounds) || len(d.counts) != len(h.data.counts) {
+		return false
+	}
+	for i, b := range d.upperBounds {
+		if b != h.data.upperBounds[i] {
+			return false
+		}
+	}
+
+	for i, c := range d.counts {
+		h.data.counts[i] += c
+	}
+	h.data.count += d.count
+	h.data.sum += d.sum
+
+	return true
+}
+
+// Observe implements prometheus.Histogram.
+func (h *mergingHistogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i := sort.SearchFloat64s(h.data.upperBounds, v); i < len(h.data.counts); i++ {
+		h.data.counts[i]++
+	}
+	h.data.count++
+	h.data.sum += v
+}
+
+// Desc implements prometheus.Metric.
+func (h *mergingHistogram) Desc() *prometheus.Desc {
+	return h.desc
+}
+
+// Write implements prometheus.Metric.
+func (h *mergingHistogram) Write(out *dto.Metric) error {
+	h.mu.Lock()
+	buckets := make(map[float64]uint64, len(h.data.upperBounds))
+	for i, b := range h.data.upperBounds {
+		buckets[b] = h.data.counts[i]
+	}
+	count, sum := h.data.count, h.data.sum
+	h.mu.Unlock()
+
+	m, err := prometheus.NewConstHistogram(h.desc, count, sum, buckets)
+	if err != nil {
+		return err
+	}
+	return m.Write(out)
+}
+
+// Describe implements prometheus.Collector.
+func (h *mergingHistogram) Describe(ch chan<- *prometheus.Desc) {
+	ch <- h.desc
+}
+
+// Collect implements prometheus.Collector.
+func (h *mergingHistogram) Collect(ch chan<- prometheus.Metric) {
+	ch <- h
+}
+
+// histogramDataFromBuckets converts histogram in Prometheus data model to histogramData.
+// Buckets are sorted by upper bound. +Inf bucket is dropped, as it's equal to the count.
+func histogramDataFromBuckets(count uint64, sum float64, buckets []*dto.Bucket) *histogramData {
+	sorted := make([]*dto.Bucket, len(buckets))
+	copy(sorted, buckets)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].GetUpperBound() < sorted[j].GetUpperBound() })
+
+	d := &histogramData{count: count, sum: sum}
+	for _, b := range sorted {
+		if math.IsInf(b.GetUpperBound(), 1) {
+			continue
+		}
+		d.upperBounds = append(d.upperBounds, b.GetUpperBound())
+		d.counts = append(d.counts, b.GetCumulativeCount())
+	}
+	return d
+}
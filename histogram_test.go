@@ -0,0 +1,47 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	a "github.com/stretchr/testify/assert"
+)
+
+func Test_MergingHistogram_Observe(t *testing.T) {
+	h := newMergingHistogram(prometheus.HistogramOpts{Name: "name_of_1_metric_seconds", Help: "auto"}, []float64{0.1, 1})
+	for _, v := range []float64{0.05, 0.1, 0.5, 3} {
+		h.Observe(v)
+	}
+
+	var mm dto.Metric
+	a.NoError(t, h.Write(&mm))
+	a.Equal(t, uint64(4), mm.Histogram.GetSampleCount())
+	a.InDelta(t, 3.65, mm.Histogram.GetSampleSum(), 1e-9)
+	if a.Len(t, mm.Histogram.Bucket, 2) {
+		a.Equal(t, uint64(2), mm.Histogram.Bucket[0].GetCumulativeCount())
+		a.Equal(t, uint64(3), mm.Histogram.Bucket[1].GetCumulativeCount())
+	}
+}
+
+func Test_MergingHistogram_Merge_BucketsMismatch(t *testing.T) {
+	h := newMergingHistogram(prometheus.HistogramOpts{Name: "name_of_1_metric_seconds", Help: "auto"}, []float64{0.1, 1})
+
+	a.False(t, h.merge(&histogramData{upperBounds: []float64{0.1}, counts: []uint64{1}, count: 1}))
+	a.False(t, h.merge(&histogramData{upperBounds: []float64{0.1, 2}, counts: []uint64{1, 1}, count: 1}))
+	a.True(t, h.merge(&histogramData{upperBounds: []float64{0.1, 1}, counts: []uint64{1, 1}, count: 1}))
+}
+
+func Test_HistogramDataFromBuckets(t *testing.T) {
+	buckets := []*dto.Bucket{
+		{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(3)},
+		{UpperBound: proto.Float64(math.Inf(1)), CumulativeCount: proto.Uint64(4)},
+		{UpperBound: proto.Float64(0.1), CumulativeCount: proto.Uint64(1)},
+	}
+
+	exp := &histogramData{upperBounds: []float64{0.1, 1}, counts: []uint64{1, 3}, count: 4, sum: 5.5}
+	a.Equal(t, exp, histogramDataFromBuckets(4, 5.5, buckets))
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const kindRuleSeparator = ":"
+
+// kindRule assigns sample kind to metrics with names matching the pattern.
+type kindRule struct {
+	re   *regexp.Regexp
+	kind sampleKind
+}
+
+// kindRules picks sample kind for formats which do not carry metric type, e.g. InfluxDB line protocol.
+// First matching rule wins.
+type kindRules []kindRule
+
+// parseKindRules parses rule definitions in "kind:regexp" form, e.g. "c:_total$".
+// Only counters (c) and gauges (g) can be assigned.
+func parseKindRules(defs []string) (kindRules, error) {
+	var rules kindRules
+	for _, def := range defs {
+		parts := strings.SplitN(def, kindRuleSeparator, 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("invalid kind rule %q, expected kind:regexp", def)
+		}
+
+		kind := sampleKind(parts[0])
+		if kind != sampleCounter && kind != sampleGauge {
+			return nil, errors.Errorf("invalid kind in rule %q, expected c or g", def)
+		}
+
+		re, err := regexp.Compile(parts[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid regexp in kind rule %q", def)
+		}
+
+		rules = append(rules, kindRule{re: re, kind: kind})
+	}
+	return rules, nil
+}
+
+// kind returns kind of the first rule matching the name or def when none matches.
+func (r kindRules) kind(name string, def sampleKind) sampleKind {
+	for _, rule := range r {
+		if rule.re.MatchString(name) {
+			return rule.kind
+		}
+	}
+	return def
+}
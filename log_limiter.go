@@ -0,0 +1,37 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// logLimiter allows logging at most once per interval, so repeated errors do not flood the log.
+type logLimiter struct {
+	interval time.Duration
+
+	mu         sync.Mutex
+	loggedAt   time.Time
+	suppressed int
+}
+
+func newLogLimiter(interval time.Duration) *logLimiter {
+	return &logLimiter{interval: interval}
+}
+
+// allow checks if message representing n events can be logged now.
+// When allowed, it returns number of events suppressed since the last logged message.
+func (l *logLimiter) allow(n int) (suppressed int, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.loggedAt) < l.interval {
+		l.suppressed += n
+		return 0, false
+	}
+
+	suppressed = l.suppressed
+	l.loggedAt = now
+	l.suppressed = n - 1
+	return suppressed, true
+}
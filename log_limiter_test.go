@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	a "github.com/stretchr/testify/assert"
+)
+
+func Test_LogLimiter_Allow(t *testing.T) {
+	l := newLogLimiter(time.Hour)
+
+	suppressed, ok := l.allow(3)
+	a.True(t, ok)
+	a.Equal(t, 0, suppressed)
+
+	_, ok = l.allow(1)
+	a.False(t, ok)
+
+	// first message is due again
+	l.loggedAt = time.Now().Add(-2 * time.Hour)
+	suppressed, ok = l.allow(1)
+	a.True(t, ok)
+	a.Equal(t, 3, suppressed)
+}
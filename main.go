@@ -1,16 +1,18 @@
 package main
 
 import (
-	"flag"
 	"fmt"
 	"net/http"
+	"os"
 	"runtime"
+	"strconv"
 	"syscall"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/common/log"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
 	"github.com/vrischmann/envconfig"
 )
 
@@ -31,6 +33,98 @@ type config struct {
 	// Sync buffer size with client.
 	UDPBufferSize int `envconfig:"default=65536"`
 
+	// UDPReaders is a number of goroutines reading from UDP, each with its own socket and buffer.
+	// More than one reader requires SO_REUSEPORT support.
+	UDPReaders int `envconfig:"default=1"`
+
+	// UDPBatchSize is a maximum number of packets read by single UDP reader with one syscall.
+	// Batched reads are available only on Linux, other platforms read packets one by one.
+	UDPBatchSize int `envconfig:"default=1"`
+
+	// UDPFormat is a format of samples received over UDP.
+	// Valid formats: [native, statsd, dogstatsd, influx, graphite, prometheus, json].
+	UDPFormat string `envconfig:"default=native"`
+
+	// StatsdHost is address on which additional UDP server for StatsD clients is listening
+	StatsdHost string `envconfig:"default=0.0.0.0"`
+
+	// StatsdPort is port number on which additional UDP server for StatsD clients is listening.
+	// Zero disables the listener. Readers and batch size are the same as for main UDP server.
+	StatsdPort int `envconfig:"default=0"`
+
+	// StatsdFormat is a format of samples received by StatsD UDP server.
+	StatsdFormat string `envconfig:"default=statsd"`
+
+	// DogstatsdBareTagPolicy defines handling of DogStatsD tags without value, e.g. "#canary".
+	// Valid policies:
+	// - drop: tag is ignored
+	// - true: tag is mapped to label with "true" value
+	// - reject: whole line is skipped
+	DogstatsdBareTagPolicy string `envconfig:"default=drop"`
+
+	// InfluxHost is address on which additional UDP server for InfluxDB line protocol is listening
+	InfluxHost string `envconfig:"default=0.0.0.0"`
+
+	// InfluxPort is port number on which additional UDP server for InfluxDB line protocol is listening.
+	// Zero disables the listener. Readers and batch size are the same as for main UDP server.
+	InfluxPort int `envconfig:"default=0"`
+
+	// InfluxKindRules picks kind of samples received in InfluxDB line protocol, as it does not carry metric type.
+	// Rules are comma separated in "kind:regexp" form and matched against sample names, first match wins.
+	// Valid kinds: [c, g]. Samples not matching any rule are gauges, which is all of them by default.
+	// Counter rules must match only fields holding increments, as values of counters are added.
+	InfluxKindRules []string `envconfig:"optional"`
+
+	// GraphiteHost is address on which TCP server for Graphite plaintext protocol is listening
+	GraphiteHost string `envconfig:"default=0.0.0.0"`
+
+	// GraphitePort is port number on which TCP server for Graphite plaintext protocol is listening.
+	// Zero disables the listener. Max line size, max connections and idle timeout are the same as for main TCP server.
+	GraphitePort int `envconfig:"default=0"`
+
+	// GraphiteTemplates maps dotted Graphite paths to metric names and labels.
+	// Templates are comma separated in "[filter ]template" form, e.g. "servers.* _.host.metric*",
+	// first template with matching filter wins. Whole path is used as metric name when none matches.
+	GraphiteTemplates []string `envconfig:"optional"`
+
+	// GraphiteKindRules picks kind of samples received in Graphite plaintext protocol.
+	// Rules have the same form as InfluxKindRules. Samples not matching any rule are gauges, which is all of them by default.
+	GraphiteKindRules []string `envconfig:"optional"`
+
+	// TCPHost is address on which TCP server is listening
+	TCPHost string `envconfig:"default=0.0.0.0"`
+
+	// TCPPort is port number on which TCP server is listening.
+	// Zero disables the listener.
+	TCPPort int `envconfig:"default=0"`
+
+	// TCPMaxLineSize is a maximum length of a single line in bytes received over TCP.
+	// Connection sending longer line is closed.
+	TCPMaxLineSize int `envconfig:"default=65536"`
+
+	// TCPMaxConnections is a maximum number of open TCP connections.
+	// Connections above the limit are closed right after accepting.
+	TCPMaxConnections int `envconfig:"default=1024"`
+
+	// TCPIdleTimeout is a time after which TCP connection not sending any data is closed.
+	// Zero disables the timeout.
+	TCPIdleTimeout time.Duration `envconfig:"default=5m"`
+
+	// TCPFormat is a format of samples received over TCP.
+	// Valid formats: [native, statsd, dogstatsd, influx, graphite]. Prometheus and JSON formats can not be streamed.
+	TCPFormat string `envconfig:"default=native"`
+
+	// UnixSocketPath is a path of Unix domain datagram socket on which server is listening.
+	// Empty path disables the listener.
+	UnixSocketPath string `envconfig:"optional"`
+
+	// UnixSocketMode is a file mode (octal) of Unix domain datagram socket.
+	UnixSocketMode string `envconfig:"default=0666"`
+
+	// UnixSocketFormat is a format of samples received over Unix domain datagram socket.
+	// Valid formats: [native, statsd, dogstatsd, influx, graphite, prometheus, json].
+	UnixSocketFormat string `envconfig:"default=native"`
+
 	// MetricsHost is address on which metric server for prometheus is listening
 	MetricsHost string `envconfig:"default=0.0.0.0"`
 
@@ -53,9 +147,47 @@ type config struct {
 	// Metrics path for prometheus scrape
 	MetricsPath string `envconfig:"default=/metrics"`
 
+	// IngestPath is a path on metrics server accepting samples pushed with HTTP POST.
+	IngestPath string `envconfig:"default=/ingest"`
+
+	// IngestFormat is a default format of samples pushed over HTTP.
+	// It can be changed per request with "format" query parameter.
+	// Valid formats: [native, statsd, dogstatsd, influx, graphite, prometheus, json].
+	IngestFormat string `envconfig:"default=native"`
+
+	// IngestMaxBodySize is a maximum size of HTTP ingest request body in bytes.
+	IngestMaxBodySize int64 `envconfig:"default=1048576"`
+
+	// InfluxWritePath is a path on metrics server compatible with InfluxDB write endpoint.
+	// Body is limited to IngestMaxBodySize bytes.
+	InfluxWritePath string `envconfig:"default=/write"`
+
+	// OTLPMetricsPath is a path on metrics server implementing OTLP/HTTP metrics export with protobuf encoding.
+	// Body is limited to IngestMaxBodySize bytes.
+	OTLPMetricsPath string `envconfig:"default=/v1/metrics"`
+
+	// RemoteWritePath is a path on metrics server implementing Prometheus remote write receiver.
+	// Body is limited to IngestMaxBodySize bytes, both before and after decompression.
+	RemoteWritePath string `envconfig:"default=/api/v1/write"`
+
+	// RemoteWriteKindRules picks kind of series received with remote write.
+	// Rules have the same form as InfluxKindRules. Series not matching any rule are counters
+	// when name ends with _total, _count, _sum or _bucket and gauges otherwise.
+	RemoteWriteKindRules []string `envconfig:"optional"`
+
 	// ExpiryTime is the maximum duration for each metric to not be updated
 	// before it is evicted from storage.
 	ExpiryTime time.Duration `envconfig:"default=24h"`
+
+	// LateSampleTolerance is the maximum age of timestamped samples aggregated by counters, histograms,
+	// summaries and sets. Older samples are dropped. Gauges are exposed with timestamps of samples instead.
+	LateSampleTolerance time.Duration `envconfig:"default=5m"`
+
+	// MetadataFile is a path to JSON file with help and unit of metrics, overriding metadata sent by clients.
+	MetadataFile string `envconfig:"optional"`
+
+	// SetWindow is a duration of windows in which distinct tokens of set samples are counted.
+	SetWindow time.Duration `envconfig:"default=1m"`
 }
 
 func main() {
@@ -65,9 +197,11 @@ func main() {
 		exitOnFatal(err, "init config")
 	}
 
-	// convert env config to flag one for prometheus log package
-	flag.Set("log.level", cfg.LogLevel)
-	flag.Parse()
+	logLevel, err := log.ParseLevel(cfg.LogLevel)
+	if err != nil {
+		exitOnFatal(err, "init logging")
+	}
+	log.SetLevel(logLevel)
 
 	log.Debugf("Parsed config from env => %+v", *cfg)
 
@@ -86,23 +220,118 @@ func main() {
 	}
 	log.Debugf("Sample hasher used: %s", cfg.SampleHasher)
 
+	dogStatsD, err := newDogStatsDFormat(cfg.DogstatsdBareTagPolicy)
+	if err != nil {
+		exitOnFatal(err, "DogStatsD format init")
+	}
+	registerSampleFormat(dogStatsD)
+
+	influxKindRules, err := parseKindRules(cfg.InfluxKindRules)
+	if err != nil {
+		exitOnFatal(err, "InfluxDB format init")
+	}
+	influx := newInfluxFormat(influxKindRules)
+	registerSampleFormat(influx)
+
+	graphiteTemplates, err := parseGraphiteTemplates(cfg.GraphiteTemplates)
+	if err != nil {
+		exitOnFatal(err, "Graphite format init")
+	}
+	graphiteKindRules, err := parseKindRules(cfg.GraphiteKindRules)
+	if err != nil {
+		exitOnFatal(err, "Graphite format init")
+	}
+	graphite := newGraphiteFormat(graphiteTemplates, graphiteKindRules)
+	registerSampleFormat(graphite)
+
 	// TODO(szpakas): attach to signals for graceful shutdown and call c.stop()
 	c := newCollector(cfg.ExpiryTime)
+	c.setWindow = cfg.SetWindow
+	c.lateSampleTolerance = cfg.LateSampleTolerance
+	if cfg.MetadataFile != "" {
+		configured, err := loadMetadataConfig(cfg.MetadataFile)
+		if err != nil {
+			exitOnFatal(err, "metadata config init")
+		}
+		c.metadata = newMetadataStore(configured)
+		log.Infof("Loaded metadata of %d metrics from %s", len(configured), cfg.MetadataFile)
+	}
 	prometheus.MustRegister(c)
 	c.start()
 
 	s := newServer(c.Write, cfg.UDPBufferSize)
-	log.Infof("Starting ingrees samples server => %s:%d with buffersize %d, expiry time %s", cfg.UDPHost, cfg.UDPPort, cfg.UDPBufferSize, cfg.ExpiryTime.String())
-	if err := s.Listen(cfg.UDPHost, cfg.UDPPort); err != nil {
+	log.Infof("Starting ingrees samples server => %s:%d with buffersize %d, %d readers, batch size %d, expiry time %s", cfg.UDPHost, cfg.UDPPort, cfg.UDPBufferSize, cfg.UDPReaders, cfg.UDPBatchSize, cfg.ExpiryTime.String())
+	if cfg.UDPBatchSize > 1 && !udpBatchSupported {
+		log.Warnf("Batched UDP reads are not supported on this platform, reading packets one by one")
+	}
+	if err := s.Listen(cfg.UDPHost, cfg.UDPPort, cfg.UDPReaders, cfg.UDPBatchSize, mustLookupSampleFormat(cfg.UDPFormat, "UDP server init")); err != nil {
 		exitOnFatal(err, "UDP server init")
 	}
 
-	http.Handle(cfg.MetricsPath, prometheus.Handler())
+	if cfg.StatsdPort != 0 {
+		log.Infof("Starting ingress StatsD samples server => %s:%d with format %s", cfg.StatsdHost, cfg.StatsdPort, cfg.StatsdFormat)
+		if err := s.Listen(cfg.StatsdHost, cfg.StatsdPort, cfg.UDPReaders, cfg.UDPBatchSize, mustLookupSampleFormat(cfg.StatsdFormat, "StatsD server init")); err != nil {
+			exitOnFatal(err, "StatsD server init")
+		}
+	}
+
+	if cfg.InfluxPort != 0 {
+		log.Infof("Starting ingress InfluxDB samples server => %s:%d", cfg.InfluxHost, cfg.InfluxPort)
+		if err := s.Listen(cfg.InfluxHost, cfg.InfluxPort, cfg.UDPReaders, cfg.UDPBatchSize, influx); err != nil {
+			exitOnFatal(err, "InfluxDB server init")
+		}
+	}
+
+	if cfg.TCPPort != 0 {
+		log.Infof("Starting ingress TCP samples server => %s:%d with max line size %d", cfg.TCPHost, cfg.TCPPort, cfg.TCPMaxLineSize)
+		if err := s.ListenTCP(cfg.TCPHost, cfg.TCPPort, cfg.TCPMaxLineSize, cfg.TCPMaxConnections, cfg.TCPIdleTimeout, mustLookupSampleFormat(cfg.TCPFormat, "TCP server init")); err != nil {
+			exitOnFatal(err, "TCP server init")
+		}
+	}
+
+	if cfg.GraphitePort != 0 {
+		log.Infof("Starting ingress Graphite samples server => %s:%d with %d templates", cfg.GraphiteHost, cfg.GraphitePort, len(graphiteTemplates))
+		if err := s.ListenTCP(cfg.GraphiteHost, cfg.GraphitePort, cfg.TCPMaxLineSize, cfg.TCPMaxConnections, cfg.TCPIdleTimeout, graphite); err != nil {
+			exitOnFatal(err, "Graphite server init")
+		}
+	}
+
+	if cfg.UnixSocketPath != "" {
+		mode, err := strconv.ParseUint(cfg.UnixSocketMode, 8, 32)
+		if err != nil {
+			exitOnFatal(errors.Wrap(err, "invalid socket mode"), "Unix socket server init")
+		}
+
+		log.Infof("Starting ingress Unix socket samples server => %s with mode %04o", cfg.UnixSocketPath, mode)
+		if err := s.ListenUnixgram(cfg.UnixSocketPath, os.FileMode(mode), mustLookupSampleFormat(cfg.UnixSocketFormat, "Unix socket server init")); err != nil {
+			exitOnFatal(err, "Unix socket server init")
+		}
+	}
+
+	gatherer := metadataGatherer{prometheus.DefaultGatherer, c.metadata}
+	http.Handle(cfg.MetricsPath, promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{})))
 	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "ok")
 	})
 	log.Infof("Handle metrics endpoint in %s", cfg.MetricsPath)
 
+	http.Handle(cfg.IngestPath, s.ingestHandler(cfg.IngestMaxBodySize, mustLookupSampleFormat(cfg.IngestFormat, "ingest endpoint init")))
+	log.Infof("Handle ingest endpoint in %s", cfg.IngestPath)
+
+	http.Handle(cfg.InfluxWritePath, s.influxWriteHandler(cfg.IngestMaxBodySize, influx))
+	log.Infof("Handle InfluxDB write endpoint in %s", cfg.InfluxWritePath)
+
+	http.Handle(cfg.OTLPMetricsPath, s.otlpMetricsHandler(cfg.IngestMaxBodySize, newOTLPFormat(newCumulativeTracker(cfg.ExpiryTime))))
+	log.Infof("Handle OTLP metrics endpoint in %s", cfg.OTLPMetricsPath)
+
+	remoteWriteKindRules, err := parseKindRules(cfg.RemoteWriteKindRules)
+	if err != nil {
+		exitOnFatal(err, "remote write endpoint init")
+	}
+	remoteWrite := newRemoteWriteFormat(remoteWriteKindRules, newCumulativeTracker(cfg.ExpiryTime), int(cfg.IngestMaxBodySize))
+	http.Handle(cfg.RemoteWritePath, s.remoteWriteHandler(cfg.IngestMaxBodySize, remoteWrite))
+	log.Infof("Handle remote write endpoint in %s", cfg.RemoteWritePath)
+
 	metricsListenOn := fmt.Sprintf("%s:%d", cfg.MetricsHost, cfg.MetricsPort)
 	log.Infof("Starting metrics server => %s", metricsListenOn)
 	if err := http.ListenAndServe(metricsListenOn, nil); err != nil {
@@ -110,6 +339,15 @@ func main() {
 	}
 }
 
+// mustLookupSampleFormat returns sample format by name or exits when it's unknown.
+func mustLookupSampleFormat(name string, loc string) *sampleFormat {
+	f, err := lookupSampleFormat(name)
+	if err != nil {
+		exitOnFatal(err, loc)
+	}
+	return f
+}
+
 func exitOnFatal(err error, loc string) {
 	log.Fatalf("EXIT on %s: err=%s\n", loc, err)
 	syscall.Exit(1)
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// metadataMaxNames limits number of metric names with metadata sent by clients.
+// Metadata of other names is ignored.
+const metadataMaxNames = 10000
+
+// metricMetadata describes all series of the metric with given name.
+type metricMetadata struct {
+	Help string `json:"help"`
+	Unit string `json:"unit"`
+}
+
+// merge returns metadata with fields of o overriding the ones of m, when set.
+func (m metricMetadata) merge(o metricMetadata) metricMetadata {
+	if o.Help != "" {
+		m.Help = o.Help
+	}
+	if o.Unit != "" {
+		m.Unit = o.Unit
+	}
+	return m
+}
+
+// metadataStore holds metadata of metrics by name.
+// Metadata sent by clients is overridden by the configured one.
+type metadataStore struct {
+	mu         sync.RWMutex
+	sent       map[string]metricMetadata
+	configured map[string]metricMetadata
+}
+
+// newMetadataStore creates store with metadata configured centrally, which can be nil.
+func newMetadataStore(configured map[string]metricMetadata) *metadataStore {
+	return &metadataStore{
+		sent:       make(map[string]metricMetadata),
+		configured: configured,
+	}
+}
+
+// update merges metadata sent by client into the one already known.
+func (m *metadataStore) update(name string, md metricMetadata) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old, found := m.sent[name]
+	if !found && len(m.sent) >= metadataMaxNames {
+		return
+	}
+	m.sent[name] = old.merge(md)
+}
+
+// get returns metadata of the metric and whether any is known.
+func (m *metadataStore) get(name string) (metricMetadata, bool) {
+	m.mu.RLock()
+	sent, sentFound := m.sent[name]
+	m.mu.RUnlock()
+
+	configured, configuredFound := m.configured[name]
+	return sent.merge(configured), sentFound || configuredFound
+}
+
+// loadMetadataConfig reads metadata of metrics from JSON file mapping metric names to help and unit, e.g.
+//
+//	{"http_request_duration_seconds": {"help": "Duration of HTTP requests.", "unit": "seconds"}}
+func loadMetadataConfig(path string) (map[string]metricMetadata, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading metadata config")
+	}
+
+	var out map[string]metricMetadata
+	if err := json.Unmarshal(b, &out); err != nil {
+		return nil, errors.Wrapf(err, "decoding metadata config %s", path)
+	}
+	for name, md := range out {
+		if !metricNameRE.MatchString(name) {
+			return nil, errors.Errorf("invalid metric name %q in metadata config", name)
+		}
+		if md.Unit != "" && !isMetadataUnit([]byte(md.Unit)) {
+			return nil, errors.Errorf("invalid unit %q of metric %q in metadata config", md.Unit, name)
+		}
+	}
+	return out, nil
+}
+
+// metadataGatherer applies metadata to metric families gathered by wrapped gatherer.
+//
+// Metadata is applied to gathered families instead of metrics created by collector, as all series
+// of the family must have the same help. Series created before metadata arrived would make it inconsistent.
+// Unit is passed in protobuf exposition format only.
+type metadataGatherer struct {
+	prometheus.Gatherer
+	store *metadataStore
+}
+
+// Gather implements prometheus.Gatherer.
+func (g metadataGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.Gatherer.Gather()
+	for _, mf := range families {
+		md, found := g.store.get(mf.GetName())
+		if !found {
+			continue
+		}
+		if md.Help != "" {
+			mf.Help = &md.Help
+		}
+		if md.Unit != "" {
+			mf.Unit = &md.Unit
+		}
+	}
+	return families, err
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	a "github.com/stretchr/testify/assert"
+)
+
+func Test_MetadataStore_Get(t *testing.T) {
+	m := newMetadataStore(map[string]metricMetadata{
+		"name_of_1_metric_seconds": {Help: "Configured help."},
+		"name_of_2_metric_bytes":   {Unit: "bytes"},
+	})
+	m.update("name_of_1_metric_seconds", metricMetadata{Help: "Sent help."})
+	m.update("name_of_1_metric_seconds", metricMetadata{Unit: "seconds"})
+	m.update("name_of_3_metric", metricMetadata{Help: "Sent help."})
+
+	cases := map[string]struct {
+		name     string
+		exp      metricMetadata
+		expFound bool
+	}{
+		"configured overrides sent": {"name_of_1_metric_seconds", metricMetadata{Help: "Configured help.", Unit: "seconds"}, true},
+		"configured only":           {"name_of_2_metric_bytes", metricMetadata{Unit: "bytes"}, true},
+		"sent only":                 {"name_of_3_metric", metricMetadata{Help: "Sent help."}, true},
+		"unknown":                   {"name_of_4_metric", metricMetadata{}, false},
+	}
+
+	for k, tc := range cases {
+		got, found := m.get(tc.name)
+		a.Equal(t, tc.exp, got, k)
+		a.Equal(t, tc.expFound, found, k)
+	}
+}
+
+func Test_MetadataStore_Update_Limit(t *testing.T) {
+	m := newMetadataStore(nil)
+	for i := 0; i < metadataMaxNames; i++ {
+		m.sent[string(rune(i))] = metricMetadata{}
+	}
+
+	m.update("name_of_1_metric", metricMetadata{Help: "Ignored."})
+	_, found := m.get("name_of_1_metric")
+	a.False(t, found)
+
+	// known names are still updated
+	m.update(string(rune(0)), metricMetadata{Help: "Updated."})
+	got, _ := m.get(string(rune(0)))
+	a.Equal(t, "Updated.", got.Help)
+}
+
+func Test_LoadMetadataConfig(t *testing.T) {
+	cases := map[string]struct {
+		in     string
+		exp    map[string]metricMetadata
+		expErr bool
+	}{
+		"valid": {
+			in:  `{"name_of_1_metric_seconds": {"help": "Duration of requests.", "unit": "seconds"}}`,
+			exp: map[string]metricMetadata{"name_of_1_metric_seconds": {Help: "Duration of requests.", Unit: "seconds"}},
+		},
+		"malformed":    {in: `{"name_of_1_metric_seconds": "x"}`, expErr: true},
+		"invalid name": {in: `{"name.of.1": {"help": "x"}}`, expErr: true},
+		"invalid unit": {in: `{"name_of_1_metric": {"unit": "milli-seconds"}}`, expErr: true},
+	}
+
+	for k, tc := range cases {
+		path := filepath.Join(t.TempDir(), "metadata.json")
+		if err := os.WriteFile(path, []byte(tc.in), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := loadMetadataConfig(path)
+		if tc.expErr {
+			a.Error(t, err, k)
+			continue
+		}
+		a.NoError(t, err, k)
+		a.Equal(t, tc.exp, got, k)
+	}
+
+	_, err := loadMetadataConfig(filepath.Join(t.TempDir(), "missing.json"))
+	a.Error(t, err)
+}
+
+func Test_MetadataGatherer_Gather(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		prometheus.NewGauge(prometheus.GaugeOpts{Name: "name_of_1_metric_seconds", Help: "auto"}),
+		prometheus.NewGauge(prometheus.GaugeOpts{Name: "name_of_2_metric", Help: "auto"}),
+	)
+	store := newMetadataStore(nil)
+	store.update("name_of_1_metric_seconds", metricMetadata{Help: "Duration of requests.", Unit: "seconds"})
+
+	families, err := metadataGatherer{reg, store}.Gather()
+
+	a.NoError(t, err)
+	if a.Len(t, families, 2) {
+		a.Equal(t, "Duration of requests.", families[0].GetHelp())
+		a.Equal(t, "seconds", families[0].GetUnit())
+		a.Equal(t, "auto", families[1].GetHelp())
+		a.Nil(t, families[1].Unit)
+	}
+}
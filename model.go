@@ -1,6 +1,9 @@
 package main
 
 import (
+	"math"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -28,6 +31,42 @@ const (
 	// sampleHistogramLinear represents histogram with linearly spaced buckets.
 	// See Prometheus Go client LinearBuckets for details.
 	sampleHistogramLinear sampleKind = "hl"
+
+	// sampleHistogramExponential represents histogram with exponentially spaced buckets.
+	// See Prometheus Go client ExponentialBuckets for details.
+	sampleHistogramExponential sampleKind = "he"
+
+	// sampleHistogramNative represents Prometheus native histogram with sparse exponential buckets.
+	// See Prometheus Go client HistogramOpts.NativeHistogramBucketFactor for details.
+	sampleHistogramNative sampleKind = "hn"
+
+	// sampleSummary represents summary with quantiles calculated over sliding time window.
+	sampleSummary sampleKind = "s"
+
+	// sampleSet represents set of distinct tokens, counted per window.
+	sampleSet sampleKind = "u"
+
+	// sampleMetadata carries help or unit of the metric instead of the measurement.
+	// It's not available as a kind of sample line in the native format.
+	sampleMetadata sampleKind = "metadata"
+
+	// sampleHistogramMerged represents histogram aggregated by the client, merged bucket by bucket.
+	// It's not available in the native format.
+	sampleHistogramMerged sampleKind = "hm"
+)
+
+// gaugeOp defines how gauge sample value is applied to the gauge.
+type gaugeOp int
+
+const (
+	// gaugeOpSet replaces gauge value with sample value.
+	gaugeOpSet gaugeOp = iota
+
+	// gaugeOpAdd adds sample value to the gauge.
+	gaugeOpAdd
+
+	// gaugeOpSub subtracts sample value from the gauge.
+	gaugeOpSub
 )
 
 // sample represents single measurement submitted to the system.
@@ -45,8 +84,97 @@ type sample struct {
 	// value of the sample
 	value float64
 
+	// token is a value of the set sample, distinct tokens are counted
+	token string
+
 	// histogramDef is a set of values used in mapping for the histogram types
 	histogramDef []string
+
+	// summaryDef is a set of objectives (quantile:error) and optional max age used in mapping for the summary type
+	summaryDef []string
+
+	// gaugeOp is an operation applied to the gauge. Set by default.
+	gaugeOp gaugeOp
+
+	// sampleRate is a fraction of measurements sent by the client, e.g. 0.1 when only
+	// every 10th measurement is sent. Zero means sample was not sampled.
+	sampleRate float64
+
+	// meta holds help or unit of the metric for sampleMetadata kind
+	meta metricMetadata
+
+	// timestamp is the time when the sample was observed. Zero means time of arrival.
+	timestamp time.Time
+
+	// histogram holds observations aggregated by the client for sampleHistogramMerged kind
+	histogram *histogramData
+
+	// pooled is set for samples taken from samplePool
+	pooled bool
+}
+
+// samplePool holds samples reused by parsers of hot paths, so memory of samples and their labels
+// is not allocated for each packet. Samples are returned to the pool by the collector once processed.
+var samplePool = sync.Pool{
+	New: func() interface{} {
+		return &sample{labels: make(map[string]string)}
+	},
+}
+
+// getSample takes empty sample from samplePool.
+// Labels of the sample are owned by it, they must not be shared with other samples.
+func getSample() *sample {
+	s := samplePool.Get().(*sample)
+	s.pooled = true
+	return s
+}
+
+// release returns sample taken with getSample to samplePool. Sample must not be used afterwards.
+// Other samples are left for garbage collector, as their labels may be shared.
+func (s *sample) release() {
+	if !s.pooled {
+		return
+	}
+	labels := s.labels
+	clear(labels)
+	*s = sample{labels: labels}
+	samplePool.Put(s)
+}
+
+// sampleMinRate is the lowest sample rate accepted from clients.
+// Histogram and summary samples are observed once per measurement they represent,
+// so it bounds the work done by collector for a single sample.
+const sampleMinRate = 0.001
+
+// isValidSampleRate checks if sample rate is in [sampleMinRate, 1] range.
+func isValidSampleRate(rate float64) bool {
+	return rate >= sampleMinRate && rate <= 1
+}
+
+// weight returns number of measurements represented by the sample.
+// It's an inverse of sample rate for sampled samples and 1 for the others.
+// Weight is capped by inverse of sampleMinRate.
+func (s *sample) weight() float64 {
+	if s.sampleRate > 0 && s.sampleRate < 1 {
+		return 1 / math.Max(s.sampleRate, sampleMinRate)
+	}
+	return 1
+}
+
+// reservedLabelError checks that sample has no label reserved for its kind, e.g. "le" of histograms.
+// Prometheus client panics on metrics with such labels, so these samples must not reach collector.
+func (s *sample) reservedLabelError() *parseError {
+	switch s.kind {
+	case sampleHistogram, sampleHistogramLinear, sampleHistogramExponential, sampleHistogramNative, sampleHistogramMerged:
+		if _, found := s.labels[histogramBucketLabel]; found {
+			return newParseError(parseErrorBadLabel, "label %q not allowed for histograms", histogramBucketLabel)
+		}
+	case sampleSummary:
+		if _, found := s.labels[summaryQuantileLabel]; found {
+			return newParseError(parseErrorBadLabel, "label %q not allowed for summaries", summaryQuantileLabel)
+		}
+	}
+	return nil
 }
 
 // hash calculates a hash of the sample so it can be recognized.
@@ -72,16 +200,19 @@ func (u *UpdatingCounter) Touch() {
 	u.UpdatedAt = time.Now()
 }
 
-// UpdatingGauge wraps prometheus.Gauge, adding last update time.
+// UpdatingGauge wraps prometheus.Gauge, adding last update time and timestamp of the value.
 type UpdatingGauge struct {
 	Gauge     prometheus.Gauge
 	UpdatedAt time.Time
+
+	// timestamp of the value in Unix nanoseconds, zero when value has no timestamp
+	timestamp atomic.Int64
 }
 
 // NewUpdatingGauge creates new instance of UpdatingGauge, with UpdatedAt
 // set to creation time.
 func NewUpdatingGauge(c prometheus.Gauge) *UpdatingGauge {
-	return &UpdatingGauge{c, time.Now()}
+	return &UpdatingGauge{Gauge: c, UpdatedAt: time.Now()}
 }
 
 // Touch updates UpdatedAt field to current time.
@@ -89,6 +220,40 @@ func (u *UpdatingGauge) Touch() {
 	u.UpdatedAt = time.Now()
 }
 
+// Timestamp returns the time when the value was observed, zero when it's not known.
+func (u *UpdatingGauge) Timestamp() time.Time {
+	if ns := u.timestamp.Load(); ns != 0 {
+		return time.Unix(0, ns)
+	}
+	return time.Time{}
+}
+
+// SetTimestamp sets the time when the value was observed. Zero time removes the timestamp.
+func (u *UpdatingGauge) SetTimestamp(t time.Time) {
+	var ns int64
+	if !t.IsZero() {
+		ns = t.UnixNano()
+	}
+	u.timestamp.Store(ns)
+}
+
+// UpdatingSummary wraps prometheus.Summary, adding last update time.
+type UpdatingSummary struct {
+	Summary   prometheus.Summary
+	UpdatedAt time.Time
+}
+
+// NewUpdatingSummary creates new instance of UpdatingSummary, with UpdatedAt
+// set to creation time.
+func NewUpdatingSummary(c prometheus.Summary) *UpdatingSummary {
+	return &UpdatingSummary{c, time.Now()}
+}
+
+// Touch updates UpdatedAt field to current time.
+func (u *UpdatingSummary) Touch() {
+	u.UpdatedAt = time.Now()
+}
+
 // UpdatingHistogram wraps prometheus.Histogram, adding last update time.
 type UpdatingHistogram struct {
 	Histogram prometheus.Histogram
@@ -105,3 +270,51 @@ func NewUpdatingHistogram(c prometheus.Histogram) *UpdatingHistogram {
 func (u *UpdatingHistogram) Touch() {
 	u.UpdatedAt = time.Now()
 }
+
+// UpdatingSet wraps prometheus.Gauge exposing number of distinct tokens, adding last update time.
+//
+// Tokens are counted in windows. Gauge holds the count of the last complete window,
+// it's not exposed until the first window is complete.
+type UpdatingSet struct {
+	Gauge     prometheus.Gauge
+	UpdatedAt time.Time
+
+	// mu protects set and complete, as windows are closed concurrently with processing
+	mu       sync.Mutex
+	set      *uniqueSet
+	complete bool
+}
+
+// NewUpdatingSet creates new instance of UpdatingSet, with UpdatedAt
+// set to creation time.
+func NewUpdatingSet(c prometheus.Gauge) *UpdatingSet {
+	return &UpdatingSet{Gauge: c, UpdatedAt: time.Now(), set: newUniqueSet()}
+}
+
+// Touch updates UpdatedAt field to current time.
+func (u *UpdatingSet) Touch() {
+	u.UpdatedAt = time.Now()
+}
+
+// Add adds token to the current window.
+func (u *UpdatingSet) Add(token string) {
+	u.mu.Lock()
+	u.set.add(token)
+	u.mu.Unlock()
+}
+
+// CloseWindow sets the gauge to number of distinct tokens in the current window and starts a new one.
+func (u *UpdatingSet) CloseWindow() {
+	u.mu.Lock()
+	u.Gauge.Set(float64(u.set.count()))
+	u.set.reset()
+	u.complete = true
+	u.mu.Unlock()
+}
+
+// Complete checks if at least one window was closed, so the gauge holds a count.
+func (u *UpdatingSet) Complete() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.complete
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
 	"io"
+	"math"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type sampleParserState int
@@ -14,135 +16,807 @@ const (
 	sampleParserStateSearching sampleParserState = iota + 1
 	sampleParserStateSample
 
-	sampleParserLabelsSeparator         = ";"
-	sampleParserHistogramDefSeparator   = ";"
-	sampleParserLabelFromValueSeparator = "="
-	sampleParserSamplePartsSeparator    = "|"
+	sampleParserLabelsSeparator           = ";"
+	sampleParserHistogramDefSeparator     = ";"
+	sampleParserSummaryDefSeparator       = ";"
+	sampleParserSummaryObjectiveSeparator = ":"
+	sampleParserLabelFromValueSeparator   = "="
+	sampleParserSamplePartsSeparator      = "|"
+
+	sampleParserEscape = '\\'
+	sampleParserQuote  = '"'
+
+	sampleParserSampleRatePrefix = '@'
+	sampleParserTimestampPrefix  = 'T'
+
+	sampleParserMetadataPrefix = '#'
+	sampleParserMetadataHelp   = "HELP"
+	sampleParserMetadataUnit   = "UNIT"
+
+	// sampleParserMaxTimestamp is the latest sample timestamp accepted, in Unix seconds.
+	// Later ones can not be represented in Unix nanoseconds.
+	sampleParserMaxTimestamp = math.MaxInt64 / 1e9
+
+	sampleParserGaugeAddSuffix = "+"
+	sampleParserGaugeSubSuffix = "-"
+
+	// histogramBucketLabel is a label name reserved for histogram buckets.
+	histogramBucketLabel = "le"
+
+	// summaryQuantileLabel is reserved for quantiles of summaries.
+	summaryQuantileLabel = "quantile"
+
+	// sampleParserMaxParts is a number of parts of the longest valid sample line:
+	// name, kind, type definition, labels, value, sample rate and timestamp.
+	sampleParserMaxParts = 7
 )
 
 var (
-	labelNameREPart          = `[a-zA-Z_][a-zA-Z0-9_]*`
-	labelValueREPart         = `[^;|]+`
-	labelWithValueREPart     = labelNameREPart + sampleParserLabelFromValueSeparator + labelValueREPart
-	sampleParserLabelsREPart = `(` + labelWithValueREPart + `(` + sampleParserLabelsSeparator + labelWithValueREPart + `)*)`
-
-	sampleParserSharedLabelsLineRE = regexp.MustCompile(`^` + sampleParserLabelsREPart + `$`)
-
-	metricNameREPart         = `[a-zA-Z_:][a-zA-Z0-9_:]+`
-	sampleKindREPart         = `(c|g|hl|h)`
-	sampleHistogramDefREPart = `[0-9.]+(;[0-9.]+)*`
-	// TODO(szpakas): tighter regexp with only one decimal separator
-	sampleValueREPart            = `[0-9.]+`
-	sampleParserSampleLineREPart = `^` +
-		metricNameREPart + `\|` +
-		sampleKindREPart + `\|` +
-		`(` + sampleHistogramDefREPart + `\|)?` + // optional
-		`(` + sampleParserLabelsREPart + `\|)?` + // optional
-		sampleValueREPart +
-		`$`
-	sampleHistogramDefRE = regexp.MustCompile(`^` + sampleHistogramDefREPart + `$`)
-	sampleParserSampleLineRE = regexp.MustCompile(sampleParserSampleLineREPart)
+	labelNameREPart  = `[a-zA-Z_][a-zA-Z0-9_]*`
+	metricNameREPart = `[a-zA-Z_:][a-zA-Z0-9_:]+`
+
+	// metricNameRE and labelNameRE validate names in formats other than native one.
+	metricNameRE = regexp.MustCompile(`^` + metricNameREPart + `$`)
+	labelNameRE  = regexp.MustCompile(`^` + labelNameREPart + `$`)
 )
 
+// newNativeFormat creates the format described in README.
+// Samples of batches held in memory (e.g. UDP packets) are taken from samplePool.
+func newNativeFormat() *sampleFormat {
+	f := newLineFormat("native", func() lineParser { return newNativeLineParser() })
+	f.parseBytes = func(b []byte) ([]*sample, error) {
+		p := newNativeLineParser()
+		p.pooled = true
+		return parseLinesBytes(b, p)
+	}
+	return f
+}
+
+// nativeLineParser converts consecutive lines of a single batch to samples.
+// It keeps the state of the batch (like shared labels) between lines.
+//
+// Lines are parsed byte by byte in a single pass, without copying them.
+// Only strings kept in samples (name, labels) are allocated.
+type nativeLineParser struct {
+	state        sampleParserState
+	sharedLabels map[string]string
+
+	// pooled makes parser take samples from samplePool
+	pooled bool
+}
+
+// newNativeLineParser creates parser for a new batch of lines.
+func newNativeLineParser() *nativeLineParser {
+	return &nativeLineParser{
+		state:        sampleParserStateSearching,
+		sharedLabels: make(map[string]string),
+	}
+}
+
 // parseSample reads a single sample/s description and converts it to set of samples
+// Invalid lines are skipped and reported with batchErrors. Samples parsed up to that point are returned
+// with errors.
 func parseSample(r io.Reader) ([]*sample, error) {
-	var out []*sample
+	return parseLines(r, newNativeLineParser())
+}
+
+// parseLine implements lineParser.
+func (p *nativeLineParser) parseLine(text string, out []*sample) ([]*sample, error) {
+	return p.parseLineBytes([]byte(text), out)
+}
+
+// parseLineBytes implements byteLineParser.
+// Empty lines are skipped silently, other invalid lines are explained with *parseError.
+func (p *nativeLineParser) parseLineBytes(line []byte, out []*sample) ([]*sample, error) {
+	if len(line) == 0 {
+		return out, nil
+	}
+
+	// metadata lines do not change state, they can be sent anywhere in the batch
+	if line[0] == sampleParserMetadataPrefix {
+		s, err := p.parseMetadataLine(line)
+		if err != nil {
+			return out, err
+		}
+		return append(out, s), nil
+	}
+
+	switch p.state {
+	case sampleParserStateSearching:
+		if scanLabels(line, nil) {
+			p.sharedLabels = make(map[string]string) // reset
+			scanLabels(line, p.sharedLabels)
+			p.state = sampleParserStateSample
+			return out, nil
+		}
+
+	case sampleParserStateSample:
+		if scanLabels(line, nil) {
+			return out, newParseError(parseErrorMisplacedSharedLabels, "shared labels allowed only once, before samples")
+		}
+	}
+
+	s, err := p.parseSampleLine(line)
+	if err != nil {
+		return out, err
+	}
+	return append(out, s), nil
+}
+
+// parseSampleLine converts sample line to sample or finds the reason why it's not a valid one.
+// Values not allowed for sample kind (negative counters, non-finite histogram observations) are reported with *parseError.
+func (p *nativeLineParser) parseSampleLine(line []byte) (*sample, *parseError) {
+	// parts beyond the last but two are not needed, they are only counted
+	var parts [sampleParserMaxParts + 1][]byte
+	n := splitSampleLine(line, parts[:])
+	if n < 3 {
+		return nil, newParseError(parseErrorMalformed, "expected name, kind and value separated with %q", sampleParserSamplePartsSeparator)
+	}
+
+	if !isMetricName(parts[0]) {
+		return nil, newParseError(parseErrorBadName, "invalid metric name %q", parts[0])
+	}
+
+	kind, op := sampleKindMapper(string(parts[1])), gaugeOpSet
+	if kind == sampleUnknown {
+		kind, op = gaugeOpMapper(string(parts[1]))
+	}
+	if kind == sampleUnknown {
+		return nil, newParseError(parseErrorBadKind, "unknown kind %q", parts[1])
+	}
+
+	// sample rate and timestamp follow the value, in any order
+	last := min(n, len(parts)) - 1
+	var sampleRatePart, timestampPart []byte
+	for n > 3 {
+		// token of set follows its labels, so it's never taken for sample rate or timestamp
+		if kind == sampleSet && n == 4 && scanLabels(parts[2], nil) {
+			break
+		}
+		if part := parts[last]; sampleRatePart == nil && len(part) > 0 && part[0] == sampleParserSampleRatePrefix {
+			sampleRatePart = part[1:]
+		} else if timestampPart == nil && isTimestampPart(part) {
+			timestampPart = part[1:]
+		} else {
+			break
+		}
+		last--
+		n--
+	}
+
+	// value of set is a token, not a number
+	valuePart := parts[last]
+	var value float64
+	if kind == sampleSet {
+		if len(valuePart) == 0 {
+			return nil, newParseError(parseErrorBadValue, "empty set token")
+		}
+	} else {
+		var err error
+		if value, err = strconv.ParseFloat(string(valuePart), 64); err != nil {
+			return nil, newParseError(parseErrorBadValue, "invalid value %q", valuePart)
+		}
+	}
+
+	var sampleRate float64
+	if sampleRatePart != nil {
+		var err error
+		sampleRate, err = strconv.ParseFloat(string(sampleRatePart), 64)
+		if err != nil || !isValidSampleRate(sampleRate) {
+			return nil, newParseError(parseErrorBadSampleRate, "sample rate must be in [%v, 1] range, got %q", sampleMinRate, sampleRatePart)
+		}
+	}
 
-	scanner := bufio.NewScanner(r)
+	var timestamp time.Time
+	if timestampPart != nil {
+		seconds, err := strconv.ParseFloat(string(timestampPart), 64)
+		if err != nil || !(seconds > 0 && seconds <= sampleParserMaxTimestamp) {
+			return nil, newParseError(parseErrorBadTimestamp, "timestamp must be positive Unix time in seconds, got %q", timestampPart)
+		}
+		whole, frac := math.Modf(seconds)
+		timestamp = time.Unix(int64(whole), int64(frac*1e9))
+	}
+
+	isHistogram := kind == sampleHistogram || kind == sampleHistogramLinear || kind == sampleHistogramExponential || kind == sampleHistogramNative
+	isSummary := kind == sampleSummary
+	var (
+		typeDef, labels []byte
+		// labels may be actually a malformed type definition
+		maybeTypeDef bool
+	)
+	switch middle := n - 3; {
+	case middle > 2 || middle == 2 && !isHistogram && !isSummary:
+		return nil, newParseError(parseErrorMalformed, "too many parts")
+
+	case middle == 2:
+		if !isTypeDef(kind, parts[2]) {
+			return nil, typeDefError(kind, parts[2])
+		}
+		typeDef, labels = parts[2], parts[3]
+
+	case middle == 1:
+		if (isHistogram || isSummary) && isTypeDef(kind, parts[2]) {
+			typeDef = parts[2]
+		} else {
+			labels = parts[2]
+			maybeTypeDef = isHistogram || isSummary
+		}
+	}
+
+	s := p.newSample()
+	s.name = string(parts[0])
+	s.kind = kind
+	s.value = value
+	s.gaugeOp = op
+	if kind == sampleSet {
+		s.token = unescapeLabelValue(valuePart)
+	}
+	s.sampleRate = sampleRate
+	s.timestamp = timestamp
+	for k, v := range p.sharedLabels {
+		s.labels[k] = v
+	}
+
+	if labels != nil && !scanLabels(labels, s.labels) {
+		s.release()
+		if maybeTypeDef && bytes.IndexByte(labels, sampleParserLabelFromValueSeparator[0]) < 0 {
+			return nil, typeDefError(kind, labels)
+		}
+		return nil, newParseError(parseErrorBadLabel, "invalid labels %q", labels)
+	}
+
+	if kind == sampleHistogramExponential && typeDef == nil {
+		s.release()
+		return nil, newParseError(parseErrorBadHistogramDef, "expected start, factor and count of buckets")
+	}
+
+	if typeDef != nil {
+		if isSummary {
+			s.summaryDef = appendTypeDef(s.summaryDef, typeDef)
+		} else {
+			s.histogramDef = appendTypeDef(s.histogramDef, typeDef)
+		}
+	}
+
+	if pe := s.reservedLabelError(); pe != nil {
+		s.release()
+		return nil, pe
+	}
+
+	if isHistogram {
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			s.release()
+			return nil, newParseError(parseErrorBadValue, "histogram observation must be finite, got %q", valuePart)
+		}
 
-	kindMapper := func(symbol string) sampleKind {
-		switch symbol {
-		case string(sampleCounter):
-			return sampleCounter
-		case string(sampleGauge):
-			return sampleGauge
-		case string(sampleHistogram):
-			return sampleHistogram
-		case string(sampleHistogramLinear):
-			return sampleHistogramLinear
+		// buckets are checked after labels and value, so their errors are still reported first
+		var defErr *parseError
+		switch {
+		case kind == sampleHistogram && typeDef != nil:
+			defErr = histogramDefError(typeDef)
+		case kind == sampleHistogramLinear && typeDef != nil:
+			defErr = linearDefError(typeDef)
+		case kind == sampleHistogramLinear:
+			defErr = newParseError(parseErrorBadHistogramDef, "expected start, width and count of buckets")
+		}
+		if defErr != nil {
+			s.release()
+			return nil, defErr
 		}
-		return sampleUnknown
 	}
 
-	labelsMapper := func(s string, out map[string]string) {
-		for _, labelWithValue := range strings.Split(s, sampleParserLabelsSeparator) {
-			// expecting always 2 values. It's enforced by earlier regexp check
-			labelWithValueSlice := strings.SplitN(labelWithValue, sampleParserLabelFromValueSeparator, 2)
-			out[labelWithValueSlice[0]] = labelWithValueSlice[1]
+	if isSummary {
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			s.release()
+			return nil, newParseError(parseErrorBadValue, "summary observation must be finite, got %q", valuePart)
 		}
 	}
 
-	isSampleLine := func(s string) bool {
-		return sampleParserSampleLineRE.MatchString(s)
+	if op != gaugeOpSet && (math.IsNaN(value) || math.IsInf(value, 0)) {
+		s.release()
+		return nil, newParseError(parseErrorBadValue, "gauge change must be finite, got %q", valuePart)
 	}
 
-	isHistogramDef := func(s string) bool {
-		return sampleHistogramDefRE.MatchString(s)
+	if kind == sampleCounter && !(value >= 0 && !math.IsInf(value, 0)) {
+		s.release()
+		return nil, newParseError(parseErrorBadValue, "counter value must be finite and not negative, got %q", valuePart)
 	}
 
-	parseSampleLine := func(s string, sharedLabels map[string]string) *sample {
-		samplePartsSlice := strings.Split(s, sampleParserSamplePartsSeparator)
+	return s, nil
+}
+
+// parseMetadataLine converts metadata line, e.g. "#HELP name text" or "#UNIT name seconds", to sample.
+// Space after the hash is allowed, as in Prometheus text exposition format.
+func (p *nativeLineParser) parseMetadataLine(line []byte) (*sample, *parseError) {
+	rest := bytes.TrimPrefix(line[1:], []byte(" "))
+	directive, rest, _ := bytes.Cut(rest, []byte(" "))
+	name, text, _ := bytes.Cut(rest, []byte(" "))
 
-		labels := make(map[string]string)
-		for k, v := range sharedLabels {
-			labels[k] = v
+	var md metricMetadata
+	switch string(directive) {
+	case sampleParserMetadataHelp:
+		if len(text) == 0 {
+			return nil, newParseError(parseErrorMalformed, "empty help of metric %q", name)
+		}
+		md.Help = string(text)
+	case sampleParserMetadataUnit:
+		if !isMetadataUnit(text) {
+			return nil, newParseError(parseErrorMalformed, "invalid unit %q", text)
 		}
+		md.Unit = string(text)
+	default:
+		return nil, newParseError(parseErrorMalformed, "unknown metadata %q, expected %s or %s", directive, sampleParserMetadataHelp, sampleParserMetadataUnit)
+	}
+
+	if !isMetricName(name) {
+		return nil, newParseError(parseErrorBadName, "invalid metric name %q", name)
+	}
 
-		smp := sample{
-			name:   samplePartsSlice[0],
-			kind:   kindMapper(samplePartsSlice[1]),
-			labels: labels,
+	s := p.newSample()
+	s.name = string(name)
+	s.kind = sampleMetadata
+	s.meta = md
+	return s, nil
+}
+
+// newSample creates empty sample with labels, taking it from samplePool when parser is pooled.
+func (p *nativeLineParser) newSample() *sample {
+	if p.pooled {
+		return getSample()
+	}
+	return &sample{labels: make(map[string]string)}
+}
+
+func sampleKindMapper(symbol string) sampleKind {
+	switch symbol {
+	case string(sampleCounter):
+		return sampleCounter
+	case string(sampleGauge):
+		return sampleGauge
+	case string(sampleHistogram):
+		return sampleHistogram
+	case string(sampleHistogramLinear):
+		return sampleHistogramLinear
+	case string(sampleHistogramExponential):
+		return sampleHistogramExponential
+	case string(sampleHistogramNative):
+		return sampleHistogramNative
+	case string(sampleSummary):
+		return sampleSummary
+	case string(sampleSet):
+		return sampleSet
+	}
+	return sampleUnknown
+}
+
+// gaugeOpMapper maps symbols of gauge changes, "g+" and "g-", to gauge kind and operation.
+// Plain "g" symbol sets the gauge.
+func gaugeOpMapper(symbol string) (sampleKind, gaugeOp) {
+	switch symbol {
+	case string(sampleGauge) + sampleParserGaugeAddSuffix:
+		return sampleGauge, gaugeOpAdd
+	case string(sampleGauge) + sampleParserGaugeSubSuffix:
+		return sampleGauge, gaugeOpSub
+	}
+	return sampleUnknown, gaugeOpSet
+}
+
+// isTypeDef checks if b is a valid type definition for the kind.
+func isTypeDef(kind sampleKind, b []byte) bool {
+	switch kind {
+	case sampleSummary:
+		return isSummaryDef(b)
+	case sampleHistogramExponential:
+		return exponentialDefError(b) == nil
+	case sampleHistogramNative:
+		return nativeDefError(b) == nil
+	}
+	return isHistogramDef(b)
+}
+
+// typeDefError explains invalid type definition of the kind.
+func typeDefError(kind sampleKind, b []byte) *parseError {
+	switch kind {
+	case sampleSummary:
+		return newParseError(parseErrorBadSummaryDef, "invalid summary definition %q", b)
+	case sampleHistogramExponential:
+		if err := exponentialDefError(b); err != nil {
+			return err
+		}
+	case sampleHistogramNative:
+		if err := nativeDefError(b); err != nil {
+			return err
 		}
-		smp.value, _ = strconv.ParseFloat(samplePartsSlice[len(samplePartsSlice)-1], 10)
+	}
+	return newParseError(parseErrorBadHistogramDef, "invalid histogram definition %q", b)
+}
 
-		switch smp.kind {
-		case sampleHistogramLinear, sampleHistogram:
-			// account for histogramDef
-			if len(samplePartsSlice) == 5 {
-				smp.histogramDef = strings.Split(samplePartsSlice[2], sampleParserHistogramDefSeparator)
-				labelsMapper(samplePartsSlice[3], smp.labels)
-			} else {
-				if isHistogramDef(samplePartsSlice[2]) {
-					smp.histogramDef = strings.Split(samplePartsSlice[2], sampleParserHistogramDefSeparator)
-				} else {
-					labelsMapper(samplePartsSlice[2], smp.labels)
+// histogramDefError explains why b is not a valid definition of histogram buckets, e.g. "0.1;0.5;1".
+// Nil is returned for a valid one.
+func histogramDefError(b []byte) *parseError {
+	if !isHistogramDef(b) {
+		return newParseError(parseErrorBadHistogramDef, "invalid histogram definition %q", b)
+	}
+	prev := math.Inf(-1)
+	for i := 0; len(b) > 0; i++ {
+		if i == histogramMaxBuckets {
+			return newParseError(parseErrorBadHistogramDef, "more than %d buckets", histogramMaxBuckets)
+		}
+		part := b
+		if j := bytes.IndexByte(b, sampleParserHistogramDefSeparator[0]); j >= 0 {
+			part, b = b[:j], b[j+1:]
+		} else {
+			b = nil
+		}
+		bucket, err := strconv.ParseFloat(string(part), 64)
+		if err != nil {
+			return newParseError(parseErrorBadHistogramDef, "invalid bucket %q", part)
+		}
+		// prometheus.NewHistogram panics on buckets not in increasing order
+		if bucket <= prev {
+			return newParseError(parseErrorBadHistogramDef, "buckets not in increasing order")
+		}
+		prev = bucket
+	}
+	return nil
+}
+
+// linearDefError explains why b is not a valid definition of linear buckets, e.g. "0.5;0.25;4".
+// Nil is returned for a valid one.
+func linearDefError(b []byte) *parseError {
+	if !isHistogramDef(b) {
+		return newParseError(parseErrorBadHistogramDef, "invalid histogram definition %q", b)
+	}
+	parts := bytes.Split(b, []byte(sampleParserHistogramDefSeparator))
+	if len(parts) != 3 {
+		return newParseError(parseErrorBadHistogramDef, "expected start, width and count of buckets, got %q", b)
+	}
+	start, err := strconv.ParseFloat(string(parts[0]), 64)
+	if err != nil {
+		return newParseError(parseErrorBadHistogramDef, "invalid start of buckets %q", parts[0])
+	}
+	width, err := strconv.ParseFloat(string(parts[1]), 64)
+	if err != nil {
+		return newParseError(parseErrorBadHistogramDef, "invalid width of buckets %q", parts[1])
+	}
+	count, err := strconv.Atoi(string(parts[2]))
+	if err != nil {
+		return newParseError(parseErrorBadHistogramDef, "invalid count of buckets %q", parts[2])
+	}
+	return linearBucketsError(start, width, float64(count))
+}
+
+// linearBucketsError checks arguments of prometheus.LinearBuckets, which panics on invalid ones.
+// Buckets are accumulated the same way, so they must also stay finite and in increasing order.
+func linearBucketsError(start, width, count float64) *parseError {
+	switch {
+	case count < 1 || count > histogramMaxBuckets || count != math.Trunc(count):
+		return newParseError(parseErrorBadHistogramDef, "invalid count of buckets %v", count)
+	case math.IsNaN(start) || math.IsInf(start, 0):
+		return newParseError(parseErrorBadHistogramDef, "invalid start of buckets %v", start)
+	case !(width > 0) || math.IsInf(width, 0):
+		return newParseError(parseErrorBadHistogramDef, "invalid width of buckets %v", width)
+	}
+	for bucket, i := start, 1.0; i < count; i++ {
+		next := bucket + width
+		if !(next > bucket) || math.IsInf(next, 0) {
+			return newParseError(parseErrorBadHistogramDef, "buckets not in increasing order for start %v, width %v and count %v", start, width, count)
+		}
+		bucket = next
+	}
+	return nil
+}
+
+// exponentialDefError explains why b is not a valid definition of exponential buckets, e.g. "0.001;2;16".
+// Nil is returned for a valid one.
+func exponentialDefError(b []byte) *parseError {
+	parts := bytes.Split(b, []byte(sampleParserHistogramDefSeparator))
+	if !isHistogramDef(b) || len(parts) != 3 {
+		return newParseError(parseErrorBadHistogramDef, "expected start, factor and count of buckets, got %q", b)
+	}
+	start, err := strconv.ParseFloat(string(parts[0]), 64)
+	if err != nil {
+		return newParseError(parseErrorBadHistogramDef, "invalid start of buckets %q", parts[0])
+	}
+	factor, err := strconv.ParseFloat(string(parts[1]), 64)
+	if err != nil {
+		return newParseError(parseErrorBadHistogramDef, "invalid factor of buckets %q", parts[1])
+	}
+	count, err := strconv.Atoi(string(parts[2]))
+	if err != nil {
+		return newParseError(parseErrorBadHistogramDef, "invalid count of buckets %q", parts[2])
+	}
+	return exponentialBucketsError(start, factor, float64(count))
+}
+
+// exponentialBucketsError checks arguments of prometheus.ExponentialBuckets, which panics on invalid ones.
+// Buckets must also stay finite, otherwise the upper ones would not be in increasing order.
+func exponentialBucketsError(start, factor, count float64) *parseError {
+	switch {
+	case count < 1 || count > histogramMaxBuckets || count != math.Trunc(count):
+		return newParseError(parseErrorBadHistogramDef, "invalid count of buckets %v", count)
+	case !(start > 0) || math.IsInf(start, 0):
+		return newParseError(parseErrorBadHistogramDef, "invalid start of buckets %v", start)
+	case !(factor > 1) || math.IsInf(factor, 0):
+		return newParseError(parseErrorBadHistogramDef, "invalid factor of buckets %v", factor)
+	case math.IsInf(start*math.Pow(factor, count-1), 0):
+		return newParseError(parseErrorBadHistogramDef, "buckets overflow for start %v, factor %v and count %v", start, factor, count)
+	}
+	return nil
+}
+
+// appendTypeDef appends elements of type definition separated with semicolon to out.
+func appendTypeDef(out []string, def []byte) []string {
+	for {
+		i := bytes.IndexByte(def, sampleParserHistogramDefSeparator[0])
+		if i < 0 {
+			return append(out, string(def))
+		}
+		out = append(out, string(def[:i]))
+		def = def[i+1:]
+	}
+}
+
+// splitSampleLine splits line into parts separated with pipe and returns their number.
+// Pipes escaped with backslash or placed inside quoted label value do not separate parts.
+// When there are more parts than fit into out, the last three elements of out hold the last three parts
+// (value, sample rate and timestamp).
+func splitSampleLine(line []byte, out [][]byte) int {
+	var (
+		n          int
+		start      int
+		inLabelKey = true
+	)
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; c {
+		case sampleParserQuote:
+			// quoted part, e.g. token of set, can contain separators
+			if i == start {
+				if end := quotedValueEnd(line, i); end > 0 {
+					i = end
 				}
 			}
-		default:
-			if len(samplePartsSlice) == 4 {
-				labelsMapper(samplePartsSlice[2], smp.labels)
+		case sampleParserLabelFromValueSeparator[0]:
+			if inLabelKey {
+				inLabelKey = false
+				if end := quotedValueEnd(line, i+1); end > 0 {
+					i = end
+				}
+			}
+		case sampleParserLabelsSeparator[0], sampleParserSamplePartsSeparator[0]:
+			inLabelKey = true
+			if c == sampleParserSamplePartsSeparator[0] {
+				addSamplePart(out, n, line[start:i])
+				n++
+				start = i + 1
 			}
 		}
+	}
+	addSamplePart(out, n, line[start:])
+	return n + 1
+}
 
-		return &smp
+// addSamplePart puts n-th part of the sample line into out.
+// Parts beyond out length are shifted into the last three elements.
+func addSamplePart(out [][]byte, n int, part []byte) {
+	if n < len(out) {
+		out[n] = part
+		return
 	}
+	last := len(out) - 1
+	out[last-2], out[last-1], out[last] = out[last-1], out[last], part
+}
 
-	state := sampleParserStateSearching
-	sharedLabels := make(map[string]string)
+// isTimestampPart checks if b is a timestamp part of the sample line, i.e. "T" followed by a number, e.g. "T1700000000.5".
+// Other parts starting with "T", like set tokens, are not timestamps.
+func isTimestampPart(b []byte) bool {
+	if len(b) < 2 || b[0] != sampleParserTimestampPrefix {
+		return false
+	}
+	for _, c := range b[1:] {
+		if !(c >= '0' && c <= '9' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
 
-	for scanner.Scan() {
-		switch state {
-		case sampleParserStateSearching:
-			if sampleParserSharedLabelsLineRE.MatchString(scanner.Text()) {
-				sharedLabels = make(map[string]string) // reset
-				labelsMapper(scanner.Text(), sharedLabels)
-				state = sampleParserStateSample
-				continue
+// scanLabels checks if b holds labels separated with semicolon and puts them into out.
+// With nil out labels are only checked. Labels are put into out as they are scanned,
+// so out may hold part of them when b is not valid.
+// Label value is quoted only when it starts right after the label name and the closing quote ends it.
+// Unquoted value can not be empty and can not contain unescaped separators.
+func scanLabels(b []byte, out map[string]string) bool {
+	for i := 0; ; i++ {
+		nameStart := i
+		if i >= len(b) || !isLabelNameStart(b[i]) {
+			return false
+		}
+		for i++; i < len(b) && isLabelNameChar(b[i]); i++ {
+		}
+		if i >= len(b) || b[i] != sampleParserLabelFromValueSeparator[0] {
+			return false
+		}
+		name := b[nameStart:i]
+
+		i++
+		valueStart := i
+		if end := quotedValueEnd(b, i); end > 0 {
+			i = end + 1
+		} else {
+			for ; i < len(b) && b[i] != sampleParserLabelsSeparator[0]; i++ {
+				if b[i] == sampleParserSamplePartsSeparator[0] {
+					return false
+				}
+			}
+			if i == valueStart {
+				return false
 			}
-			text := scanner.Text()
+		}
 
-			if isSampleLine(text) {
-				out = append(out, parseSampleLine(scanner.Text(), sharedLabels))
-				continue
+		if out != nil {
+			out[string(name)] = unescapeLabelValue(b[valueStart:i])
+		}
+
+		if i == len(b) {
+			return true
+		}
+		if b[i] != sampleParserLabelsSeparator[0] {
+			return false
+		}
+	}
+}
+
+// quotedValueEnd returns position of the quote closing value starting at i, or -1 when value is not quoted.
+// Value is quoted only if the closing quote is followed by separator or end of b.
+func quotedValueEnd(b []byte, i int) int {
+	if i >= len(b) || b[i] != sampleParserQuote {
+		return -1
+	}
+	for j := i + 1; j < len(b); j++ {
+		switch b[j] {
+		case sampleParserEscape:
+			j++
+		case sampleParserQuote:
+			if j+1 == len(b) || b[j+1] == sampleParserLabelsSeparator[0] || b[j+1] == sampleParserSamplePartsSeparator[0] {
+				return j
 			}
+			return -1
+		}
+	}
+	return -1
+}
 
-		case sampleParserStateSample:
-			if isSampleLine(scanner.Text()) {
-				out = append(out, parseSampleLine(scanner.Text(), sharedLabels))
+// unescapeLabelValue removes quotes around quoted label value and decodes its escape sequences:
+// \\ (backslash), \; (semicolon), \| (pipe), \" (quote) and \n (new line).
+// Backslash followed by any other character is left as is. Value which is not quoted is returned as is.
+func unescapeLabelValue(v []byte) string {
+	if len(v) < 2 || quotedValueEnd(v, 0) != len(v)-1 {
+		return string(v)
+	}
+	v = v[1 : len(v)-1]
+	if bytes.IndexByte(v, sampleParserEscape) < 0 {
+		return string(v)
+	}
+
+	var b strings.Builder
+	b.Grow(len(v))
+	for i := 0; i < len(v); i++ {
+		if v[i] == sampleParserEscape && i+1 < len(v) {
+			switch v[i+1] {
+			case sampleParserEscape, ';', '|', '"':
+				i++
+			case 'n':
+				i++
+				b.WriteByte('\n')
 				continue
 			}
 		}
+		b.WriteByte(v[i])
+	}
+	return b.String()
+}
+
+// isSummaryDef checks if b is a list of objectives and max age, e.g. "0.5:0.05;0.99:0.001;5m".
+// Objective is a quantile and its allowed error, both in [0, 1] range. Max age is a positive duration,
+// it can be given only once.
+func isSummaryDef(b []byte) bool {
+	var maxAgeSeen bool
+	for _, def := range bytes.Split(b, []byte(sampleParserSummaryDefSeparator)) {
+		if i := bytes.Index(def, []byte(sampleParserSummaryObjectiveSeparator)); i >= 0 {
+			quantile, err := strconv.ParseFloat(string(def[:i]), 64)
+			if err != nil || !(quantile >= 0 && quantile <= 1) {
+				return false
+			}
+			epsilon, err := strconv.ParseFloat(string(def[i+1:]), 64)
+			if err != nil || !(epsilon >= 0 && epsilon <= 1) {
+				return false
+			}
+			continue
+		}
+
+		maxAge, err := time.ParseDuration(string(def))
+		if err != nil || maxAge <= 0 || maxAgeSeen {
+			return false
+		}
+		maxAgeSeen = true
 	}
+	return true
+}
 
-	return out, nil
+// nativeDefError explains why b is not a valid bucket factor of native histogram, e.g. "1.1".
+// Nil is returned for a valid one.
+func nativeDefError(b []byte) *parseError {
+	if !isHistogramDef(b) || bytes.IndexByte(b, sampleParserHistogramDefSeparator[0]) >= 0 {
+		return newParseError(parseErrorBadHistogramDef, "expected bucket factor, got %q", b)
+	}
+	factor, err := strconv.ParseFloat(string(b), 64)
+	if err != nil {
+		return newParseError(parseErrorBadHistogramDef, "invalid bucket factor %q", b)
+	}
+	return nativeFactorError(factor)
+}
+
+// nativeFactorError checks bucket factor of native histogram, which must be greater than 1.
+// Factors equal to or less than 1 would silently turn native histogram into classic one.
+func nativeFactorError(factor float64) *parseError {
+	if !(factor > 1) || math.IsInf(factor, 0) {
+		return newParseError(parseErrorBadHistogramDef, "invalid bucket factor %v", factor)
+	}
+	return nil
+}
+
+// isMetricName checks if b is a valid metric name, i.e. matches metricNameREPart.
+func isMetricName(b []byte) bool {
+	if len(b) < 2 || !(isLabelNameStart(b[0]) || b[0] == ':') {
+		return false
+	}
+	for _, c := range b[1:] {
+		if !isLabelNameChar(c) && c != ':' {
+			return false
+		}
+	}
+	return true
+}
+
+// isMetadataUnit checks if b is a valid unit of the metric, e.g. "seconds".
+func isMetadataUnit(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+	for _, c := range b {
+		if !isLabelNameChar(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// isLabelNameStart checks if c can start label name.
+func isLabelNameStart(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'
+}
+
+// isLabelNameChar checks if c can be a part of label name.
+func isLabelNameChar(c byte) bool {
+	return isLabelNameStart(c) || c >= '0' && c <= '9'
+}
+
+// isHistogramDef checks if b is a list of bucket definitions, e.g. "0.5;1;2".
+func isHistogramDef(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+	empty := true
+	for _, c := range b {
+		switch {
+		case c >= '0' && c <= '9' || c == '.':
+			empty = false
+		case c == sampleParserHistogramDefSeparator[0] && !empty:
+			empty = true
+		default:
+			return false
+		}
+	}
+	return !empty
 }
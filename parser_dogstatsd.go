@@ -0,0 +1,159 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	dogStatsDTagsPrefix         = "#"
+	dogStatsDTagsSeparator      = ","
+	dogStatsDTagKVSeparator     = ":"
+	dogStatsDEventPrefix        = "_e{"
+	dogStatsDServiceCheckPrefix = "_sc|"
+
+	// reservedLabelPrefix is a prefix of label names reserved for Prometheus internal use.
+	reservedLabelPrefix = "__"
+
+	// dogStatsDBareTagDrop ignores tags without value.
+	dogStatsDBareTagDrop = "drop"
+	// dogStatsDBareTagTrue maps tags without value to labels with "true" value.
+	dogStatsDBareTagTrue = "true"
+	// dogStatsDBareTagReject skips whole line with tag without value.
+	dogStatsDBareTagReject = "reject"
+)
+
+// dogStatsDFormat holds configuration shared by DogStatsD line parsers.
+type dogStatsDFormat struct {
+	// bareTagPolicy defines handling of tags without value, e.g. "#canary".
+	bareTagPolicy string
+
+	metricIgnoredTotal *prometheus.CounterVec
+}
+
+// newDogStatsDFormat creates DogStatsD format with given policy for tags without value.
+// Valid policies: [drop, true, reject].
+func newDogStatsDFormat(bareTagPolicy string) (*sampleFormat, error) {
+	switch bareTagPolicy {
+	case dogStatsDBareTagDrop, dogStatsDBareTagTrue, dogStatsDBareTagReject:
+	default:
+		return nil, errors.Errorf("unknown DogStatsD bare tag policy %q", bareTagPolicy)
+	}
+
+	f := &dogStatsDFormat{
+		bareTagPolicy: bareTagPolicy,
+		metricIgnoredTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "app_ingress_dogstatsd_ignored_total",
+				Help: "Number of DogStatsD events and service checks ignored by server.",
+			},
+			[]string{"type"},
+		),
+	}
+	prometheus.MustRegister(f.metricIgnoredTotal)
+
+	return newLineFormat("dogstatsd", func() lineParser { return dogStatsDLineParser{f} }), nil
+}
+
+// dogStatsDLineParser converts lines in DogStatsD format to samples.
+//
+// Line format is StatsD one extended with tags:
+//
+//	name:value|type[|@sampleRate][|#tag1:value1,tag2:value2]
+//
+// Tags are mapped to labels. Tag names are sanitized the same way as metric names.
+// Other DogStatsD fields (like container id or timestamp) are ignored.
+// Events and service checks are counted and skipped.
+type dogStatsDLineParser struct {
+	f *dogStatsDFormat
+}
+
+// parseLine implements lineParser.
+func (p dogStatsDLineParser) parseLine(line string, out []*sample) ([]*sample, error) {
+	switch {
+	case strings.HasPrefix(line, dogStatsDEventPrefix):
+		p.f.metricIgnoredTotal.WithLabelValues("event").Inc()
+		return out, nil
+	case strings.HasPrefix(line, dogStatsDServiceCheckPrefix):
+		p.f.metricIgnoredTotal.WithLabelValues("service_check").Inc()
+		return out, nil
+	}
+
+	if s := p.parseDogStatsDLine(line); s != nil {
+		return append(out, s), nil
+	}
+	return out, nil
+}
+
+// parseDogStatsDLine parses single DogStatsD metric line. It returns nil for invalid lines.
+func (p dogStatsDLineParser) parseDogStatsDLine(line string) *sample {
+	s, parts := parseStatsDMetric(line)
+	if s == nil {
+		return nil
+	}
+
+	var rateSeen, tagsSeen bool
+	for _, part := range parts {
+		switch {
+		case strings.HasPrefix(part, statsDSampleRatePrefix):
+			if rateSeen {
+				return nil
+			}
+			rateSeen = true
+			rate, err := strconv.ParseFloat(part[len(statsDSampleRatePrefix):], 64)
+			if err != nil || !isValidSampleRate(rate) {
+				return nil
+			}
+			s.sampleRate = rate
+
+		case strings.HasPrefix(part, dogStatsDTagsPrefix):
+			if tagsSeen {
+				return nil
+			}
+			tagsSeen = true
+			if !p.mapTags(part[len(dogStatsDTagsPrefix):], s.labels) {
+				return nil
+			}
+		}
+	}
+
+	return s
+}
+
+// mapTags converts comma separated tags to labels.
+// Returns false if line should be rejected according to bare tag policy.
+func (p dogStatsDLineParser) mapTags(tags string, labels map[string]string) bool {
+	for _, tag := range strings.Split(tags, dogStatsDTagsSeparator) {
+		if tag == "" {
+			continue
+		}
+
+		kv := strings.SplitN(tag, dogStatsDTagKVSeparator, 2)
+		name := sanitizeLabelName(kv[0])
+		if name == "" || strings.HasPrefix(name, reservedLabelPrefix) {
+			// can not be represented as label
+			continue
+		}
+		if len(kv) == 2 {
+			labels[name] = kv[1]
+			continue
+		}
+
+		switch p.f.bareTagPolicy {
+		case dogStatsDBareTagTrue:
+			labels[name] = "true"
+		case dogStatsDBareTagReject:
+			return false
+		}
+	}
+	return true
+}
+
+// sanitizeLabelName replaces characters not allowed in Prometheus label name with underscore.
+// Name starting with digit is prefixed with underscore.
+func sanitizeLabelName(name string) string {
+	return strings.Replace(sanitizeMetricName(name), ":", "_", -1)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	a "github.com/stretchr/testify/assert"
+)
+
+func Test_DogStatsDParser_Parse_Success(t *testing.T) {
+	cases := map[string]struct {
+		policy string
+		in     string
+		exp    []sample
+	}{
+		"tags": {
+			dogStatsDBareTagDrop,
+			`requests.total:1|c|#env:prod,http.method:GET,url:/a:b`,
+			[]sample{
+				{
+					name: "requests_total", kind: sampleCounter,
+					labels: map[string]string{"env": "prod", "http_method": "GET", "url": "/a:b"},
+					value:  1,
+				},
+			},
+		},
+		"sample rate and tags in any order": {
+			dogStatsDBareTagDrop,
+			`request.duration:250|ms|#env:prod|@0.5|c:83c0a99c0a54c0c187f461c7980e9b57f3f6a8b0c`,
+			[]sample{
+				{
+					name: "request_duration", kind: sampleHistogram,
+					labels: map[string]string{"env": "prod"},
+					value:  0.25, sampleRate: 0.5,
+				},
+			},
+		},
+		"bare tag dropped": {
+			dogStatsDBareTagDrop,
+			`queue.size:3|g|#env:prod,canary`,
+			[]sample{
+				{name: "queue_size", kind: sampleGauge, labels: map[string]string{"env": "prod"}, value: 3},
+			},
+		},
+		"bare tag as true": {
+			dogStatsDBareTagTrue,
+			`queue.size:3|g|#env:prod,canary`,
+			[]sample{
+				{name: "queue_size", kind: sampleGauge, labels: map[string]string{"env": "prod", "canary": "true"}, value: 3},
+			},
+		},
+		"bare tag rejected": {
+			dogStatsDBareTagReject,
+			`queue.size:3|g|#env:prod,canary
+queue.size:4|g|#env:prod`,
+			[]sample{
+				{name: "queue_size", kind: sampleGauge, labels: map[string]string{"env": "prod"}, value: 4},
+			},
+		},
+		"invalid tag names skipped": {
+			dogStatsDBareTagDrop,
+			`queue.size:3|g|#:empty,__reserved:x,,env:prod`,
+			[]sample{
+				{name: "queue_size", kind: sampleGauge, labels: map[string]string{"env": "prod"}, value: 3},
+			},
+		},
+		"sample rate below minimum skipped": {
+			dogStatsDBareTagDrop,
+			`request.duration:250|ms|@1e-9|#env:prod
+requests:1|c|@0.001`,
+			[]sample{
+				{name: "requests", kind: sampleCounter, labels: map[string]string{}, value: 1, sampleRate: 0.001},
+			},
+		},
+		"events and service checks skipped": {
+			dogStatsDBareTagDrop,
+			`_e{5,4}:title|text|#env:prod
+_sc|Redis connection|2|#env:dev
+requests:1|c`,
+			[]sample{
+				{name: "requests", kind: sampleCounter, labels: map[string]string{}, value: 1},
+			},
+		},
+	}
+
+	for k, tc := range cases {
+		func() {
+			defer thInitRegistry()()
+
+			f, err := newDogStatsDFormat(tc.policy)
+			if !a.NoError(t, err, k) {
+				return
+			}
+
+			got, err := f.parse(strings.NewReader(tc.in))
+			if !a.NoError(t, err, k) {
+				return
+			}
+
+			if !a.Len(t, got, len(tc.exp), k) {
+				return
+			}
+			for i := range tc.exp {
+				a.Equal(t, tc.exp[i], *got[i], k)
+			}
+		}()
+	}
+}
+
+func Test_DogStatsDParser_IgnoredCounted(t *testing.T) {
+	defer thInitRegistry()()
+
+	f, err := newDogStatsDFormat(dogStatsDBareTagDrop)
+	if !a.NoError(t, err) {
+		t.FailNow()
+	}
+
+	f.parse(strings.NewReader("_e{5,4}:title|text\n_e{5,4}:title|text\n_sc|Redis|2\n"))
+
+	families, err := prometheus.DefaultRegisterer.(prometheus.Gatherer).Gather()
+	if !a.NoError(t, err) || !a.Len(t, families, 1) {
+		t.FailNow()
+	}
+
+	got := make(map[string]float64)
+	for _, m := range families[0].GetMetric() {
+		got[thLabelValue(m, "type")] = m.GetCounter().GetValue()
+	}
+	a.Equal(t, map[string]float64{"event": 2, "service_check": 1}, got)
+}
+
+func Test_DogStatsDFormat_UnknownPolicy(t *testing.T) {
+	defer thInitRegistry()()
+
+	_, err := newDogStatsDFormat("keep")
+	a.Error(t, err)
+}
+
+// thLabelValue returns value of the label with given name.
+func thLabelValue(m *dto.Metric, name string) string {
+	for _, lp := range m.GetLabel() {
+		if lp.GetName() == name {
+			return lp.GetValue()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	graphitePathSeparator  = "."
+	graphiteTagsSeparator  = ";"
+	graphiteTagKVSeparator = "="
+
+	// graphiteTemplateMetric marks path node which is a part of metric name.
+	graphiteTemplateMetric = "metric"
+	// graphiteTemplateMetricRest marks path node starting the rest of the path used as metric name.
+	graphiteTemplateMetricRest = "metric*"
+	// graphiteTemplateSkip marks path node which is ignored.
+	graphiteTemplateSkip = "_"
+	// graphiteTemplateAny matches any path node in template filter.
+	graphiteTemplateAny = "*"
+)
+
+// graphiteTemplate maps nodes of dotted Graphite path to metric name and labels.
+type graphiteTemplate struct {
+	// filter selects paths the template applies to. Empty filter matches all paths.
+	filter []string
+
+	// nodes defines meaning of consecutive path nodes: label name, metric name part or skipped node.
+	nodes []string
+}
+
+// parseGraphiteTemplates parses template definitions in "[filter ]template" form,
+// e.g. "servers.* _.host.metric*" or "service.host.metric*".
+//
+// Template nodes are:
+// - metric: node is a part of metric name,
+// - metric*: node and all following ones are parts of metric name, allowed only as the last node,
+// - _: node is ignored,
+// - any other name: node is a value of label with that name.
+//
+// Filter nodes are matched with path nodes, * matches any node.
+func parseGraphiteTemplates(defs []string) ([]graphiteTemplate, error) {
+	var templates []graphiteTemplate
+	for _, def := range defs {
+		var t graphiteTemplate
+
+		fields := strings.Fields(def)
+		switch len(fields) {
+		case 1:
+		case 2:
+			t.filter = strings.Split(fields[0], graphitePathSeparator)
+			fields = fields[1:]
+		default:
+			return nil, errors.Errorf("invalid graphite template %q, expected [filter ]template", def)
+		}
+
+		var hasMetric bool
+		t.nodes = strings.Split(fields[0], graphitePathSeparator)
+		for i, node := range t.nodes {
+			switch node {
+			case graphiteTemplateMetric:
+				hasMetric = true
+			case graphiteTemplateMetricRest:
+				if i != len(t.nodes)-1 {
+					return nil, errors.Errorf("invalid graphite template %q, %s allowed only as the last node", def, graphiteTemplateMetricRest)
+				}
+				hasMetric = true
+			case graphiteTemplateSkip:
+			default:
+				if sanitizeLabelName(node) != node || strings.HasPrefix(node, reservedLabelPrefix) {
+					return nil, errors.Errorf("invalid label name %q in graphite template %q", node, def)
+				}
+			}
+		}
+		if !hasMetric {
+			return nil, errors.Errorf("invalid graphite template %q, no metric node", def)
+		}
+
+		templates = append(templates, t)
+	}
+	return templates, nil
+}
+
+// matches checks if path matches template filter.
+func (t graphiteTemplate) matches(path []string) bool {
+	if len(t.filter) > len(path) {
+		return false
+	}
+	for i, f := range t.filter {
+		if f != graphiteTemplateAny && f != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// apply returns metric name built from path and adds labels extracted from path to labels.
+// Path nodes beyond the template are ignored.
+func (t graphiteTemplate) apply(path []string, labels map[string]string) string {
+	var nameParts []string
+	for i, node := range t.nodes {
+		if i >= len(path) {
+			break
+		}
+		switch node {
+		case graphiteTemplateMetric:
+			nameParts = append(nameParts, path[i])
+		case graphiteTemplateMetricRest:
+			nameParts = append(nameParts, path[i:]...)
+		case graphiteTemplateSkip:
+		default:
+			labels[node] = path[i]
+		}
+	}
+	return strings.Join(nameParts, "_")
+}
+
+// newGraphiteFormat creates Graphite plaintext format.
+// Paths are mapped with the first matching template, whole path is used as metric name when none matches.
+// Kind of the samples is picked by rules, gauge is used when no rule matches.
+func newGraphiteFormat(templates []graphiteTemplate, rules kindRules) *sampleFormat {
+	return newLineFormat("graphite", func() lineParser { return graphiteLineParser{templates, rules} })
+}
+
+// graphiteLineParser converts lines in Graphite plaintext format to samples.
+//
+// Line format is:
+//
+//	path[;tag=value...] value [timestamp]
+//
+// Path is dotted string, e.g. "servers.hostA.cpu.load". Tags (Graphite 1.1 format) are mapped to labels.
+// Timestamp is ignored.
+type graphiteLineParser struct {
+	templates []graphiteTemplate
+	rules     kindRules
+}
+
+// parseLine implements lineParser.
+func (p graphiteLineParser) parseLine(line string, out []*sample) ([]*sample, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 {
+		return out, nil
+	}
+
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return out, nil
+	}
+	if len(fields) == 3 {
+		if _, err := strconv.ParseFloat(fields[2], 64); err != nil {
+			return out, nil
+		}
+	}
+
+	tags := strings.Split(fields[0], graphiteTagsSeparator)
+	if tags[0] == "" {
+		return out, nil
+	}
+
+	labels := make(map[string]string)
+	for _, tag := range tags[1:] {
+		kv := strings.SplitN(tag, graphiteTagKVSeparator, 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return out, nil
+		}
+		name := sanitizeLabelName(kv[0])
+		if name == "" || strings.HasPrefix(name, reservedLabelPrefix) {
+			continue
+		}
+		labels[name] = kv[1]
+	}
+
+	path := strings.Split(tags[0], graphitePathSeparator)
+	name := strings.Join(path, "_")
+	for _, t := range p.templates {
+		if t.matches(path) {
+			name = t.apply(path, labels)
+			break
+		}
+	}
+	if name == "" {
+		return out, nil
+	}
+
+	s := &sample{
+		name:   sanitizeMetricName(name),
+		labels: labels,
+		value:  value,
+	}
+	s.kind = p.rules.kind(s.name, sampleGauge)
+	if s.kind == sampleCounter && value < 0 {
+		return out, nil
+	}
+
+	return append(out, s), nil
+}
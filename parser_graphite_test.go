@@ -0,0 +1,106 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	a "github.com/stretchr/testify/assert"
+)
+
+func Test_GraphiteParser_Parse_Success(t *testing.T) {
+	templates, err := parseGraphiteTemplates([]string{
+		"servers.* _.host.metric*",
+		"stats.*.* _.service.metric.metric",
+		"service.host.metric*",
+	})
+	if !a.NoError(t, err) {
+		return
+	}
+	rules, err := parseKindRules([]string{"c:_total$"})
+	if !a.NoError(t, err) {
+		return
+	}
+	format := newGraphiteFormat(templates, rules)
+
+	cases := map[string]struct {
+		in  string
+		exp []sample
+	}{
+		"filtered template": {
+			`servers.hostA.cpu.load 0.7 1690000000`,
+			[]sample{
+				{name: "cpu_load", kind: sampleGauge, labels: map[string]string{"host": "hostA"}, value: 0.7},
+			},
+		},
+		"path nodes beyond template ignored": {
+			`stats.api.requests.total.extra 12`,
+			[]sample{
+				{name: "requests_total", kind: sampleCounter, labels: map[string]string{"service": "api"}, value: 12},
+			},
+		},
+		"default template": {
+			`api.hostA.requests.5xx 3`,
+			[]sample{
+				{name: "requests_5xx", kind: sampleGauge, labels: map[string]string{"service": "api", "host": "hostA"}, value: 3},
+			},
+		},
+		"tags": {
+			`api.hostA.disk-used;mount=/var;__name__=x 512 -1`,
+			[]sample{
+				{name: "disk_used", kind: sampleGauge, labels: map[string]string{"service": "api", "host": "hostA", "mount": "/var"}, value: 512},
+			},
+		},
+		"path shorter than template": {
+			`api.hostA 1`,
+			nil,
+		},
+		"invalid lines skipped": {
+			`api.hostA.requests
+api.hostA.requests abc
+api.hostA.requests 1 abc
+api.hostA.requests 1 2 3
+api.hostA.requests;mount 1
+api.hostA.errors_total -1
+api.hostA.requests 1`,
+			[]sample{
+				{name: "requests", kind: sampleGauge, labels: map[string]string{"service": "api", "host": "hostA"}, value: 1},
+			},
+		},
+	}
+
+	for k, tc := range cases {
+		got, err := format.parse(strings.NewReader(tc.in))
+		if !a.NoError(t, err, k) {
+			continue
+		}
+
+		if !a.Len(t, got, len(tc.exp), k) {
+			continue
+		}
+		for i := range tc.exp {
+			a.Equal(t, tc.exp[i], *got[i], k)
+		}
+	}
+}
+
+func Test_GraphiteParser_Parse_NoTemplates(t *testing.T) {
+	got, err := newGraphiteFormat(nil, nil).parse(strings.NewReader("api.hostA.requests-5xx 3\n"))
+	if a.NoError(t, err) && a.Len(t, got, 1) {
+		a.Equal(t, sample{name: "api_hostA_requests_5xx", kind: sampleGauge, labels: map[string]string{}, value: 3}, *got[0])
+	}
+}
+
+func Test_ParseGraphiteTemplates_Invalid(t *testing.T) {
+	cases := map[string]string{
+		"too many fields":     "a.* b.metric c",
+		"metric* not last":    "metric*.host",
+		"no metric node":      "service.host",
+		"invalid label name":  "service-name.metric",
+		"reserved label name": "__name__.metric",
+	}
+
+	for k, def := range cases {
+		_, err := parseGraphiteTemplates([]string{def})
+		a.Error(t, err, k)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	influxCommentPrefix = "#"
+	influxValueField    = "value"
+)
+
+// newInfluxFormat creates InfluxDB line protocol format.
+// Kind of the samples is picked by rules, gauge is used when no rule matches.
+func newInfluxFormat(rules kindRules) *sampleFormat {
+	return newLineFormat("influx", func() lineParser { return influxLineParser{rules} })
+}
+
+// influxLineParser converts lines in InfluxDB line protocol to samples.
+//
+// Line format is:
+//
+//	measurement[,tag=value...] field=value[,field=value...] [timestamp]
+//
+// Each field results in separate sample named measurement_field. Field named "value"
+// is mapped to sample named after the measurement only. Tags are mapped to labels.
+// Float, integer (3i), unsigned (3u) and boolean fields are supported, string fields are skipped.
+// Timestamp is ignored. Invalid lines are reported with *parseError.
+type influxLineParser struct {
+	rules kindRules
+}
+
+// parseLine implements lineParser.
+func (p influxLineParser) parseLine(line string, out []*sample) ([]*sample, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, influxCommentPrefix) {
+		return out, nil
+	}
+
+	sections := splitInflux(line, ' ', true)
+	if len(sections) < 2 {
+		return out, newParseError(parseErrorMalformed, "expected fields")
+	}
+	if len(sections) > 3 {
+		return out, newParseError(parseErrorMalformed, "too many sections")
+	}
+	if len(sections) == 3 {
+		if _, err := strconv.ParseInt(sections[2], 10, 64); err != nil {
+			return out, newParseError(parseErrorBadTimestamp, "invalid timestamp %q", sections[2])
+		}
+	}
+
+	series := splitInflux(sections[0], ',', false)
+	measurement := unescapeInflux(series[0])
+	if measurement == "" {
+		return out, newParseError(parseErrorBadName, "empty measurement")
+	}
+
+	labels := make(map[string]string)
+	for _, tag := range series[1:] {
+		kv := splitInflux(tag, '=', false)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return out, newParseError(parseErrorBadLabel, "invalid tag %q", tag)
+		}
+		name := sanitizeLabelName(unescapeInflux(kv[0]))
+		if strings.HasPrefix(name, reservedLabelPrefix) {
+			continue
+		}
+		labels[name] = unescapeInflux(kv[1])
+	}
+
+	var samples []*sample
+	for _, field := range splitInflux(sections[1], ',', true) {
+		kv := splitInflux(field, '=', true)
+		if len(kv) != 2 || kv[0] == "" {
+			return out, newParseError(parseErrorMalformed, "invalid field %q", field)
+		}
+
+		value, ok, valid := parseInfluxFieldValue(kv[1])
+		if !valid {
+			return out, newParseError(parseErrorBadValue, "invalid value of field %q", kv[0])
+		}
+		if !ok {
+			// field type not representable as sample
+			continue
+		}
+
+		name := measurement
+		if fieldName := unescapeInflux(kv[0]); fieldName != influxValueField {
+			name += "_" + fieldName
+		}
+		name = sanitizeMetricName(name)
+
+		// labels are never modified after parsing, so samples of the line can share them
+		s := &sample{
+			name:   name,
+			kind:   p.rules.kind(name, sampleGauge),
+			labels: labels,
+			value:  value,
+		}
+		if s.kind == sampleCounter && !(value >= 0) {
+			continue
+		}
+		samples = append(samples, s)
+	}
+
+	return append(out, samples...), nil
+}
+
+// parseInfluxFieldValue parses value of the field.
+// ok is false for valid fields which can not be represented as sample (strings),
+// valid is false for malformed values.
+func parseInfluxFieldValue(s string) (value float64, ok bool, valid bool) {
+	if s == "" {
+		return 0, false, false
+	}
+
+	switch s {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, true, true
+	case "f", "F", "false", "False", "FALSE":
+		return 0, true, true
+	}
+
+	switch s[len(s)-1] {
+	case '"':
+		return 0, false, len(s) > 1 && s[0] == '"'
+	case 'i':
+		v, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+		return float64(v), err == nil, err == nil
+	case 'u':
+		v, err := strconv.ParseUint(s[:len(s)-1], 10, 64)
+		return float64(v), err == nil, err == nil
+	}
+
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, false, false
+	}
+	return v, true, true
+}
+
+// splitInflux splits s by sep, skipping separators escaped with backslash.
+// With quotes set, separators inside double quoted strings are skipped as well.
+func splitInflux(s string, sep byte, quotes bool) []string {
+	var (
+		out      []string
+		start    int
+		inQuotes bool
+	)
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			i++
+		case c == '"' && quotes:
+			inQuotes = !inQuotes
+		case c == sep && !inQuotes:
+			out = append(out, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(out, s[start:])
+}
+
+// unescapeInflux removes backslashes escaping special characters in names and tag values.
+func unescapeInflux(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			switch s[i+1] {
+			case ',', '=', ' ', '"', '\\':
+				i++
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
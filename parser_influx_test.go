@@ -0,0 +1,120 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	a "github.com/stretchr/testify/assert"
+)
+
+func Test_InfluxParser_Parse_Success(t *testing.T) {
+	rules, err := parseKindRules([]string{"c:_total$", "c:^requests_"})
+	if !a.NoError(t, err) {
+		return
+	}
+	format := newInfluxFormat(rules)
+
+	cases := map[string]struct {
+		in  string
+		exp []sample
+	}{
+		"fields mapped to samples": {
+			`cpu,host=serverA,region=eu usage_idle=92.5,usage_user=3i 1465839830100400200`,
+			[]sample{
+				{name: "cpu_usage_idle", kind: sampleGauge, labels: map[string]string{"host": "serverA", "region": "eu"}, value: 92.5},
+				{name: "cpu_usage_user", kind: sampleGauge, labels: map[string]string{"host": "serverA", "region": "eu"}, value: 3},
+			},
+		},
+		"value field named after measurement": {
+			`temperature value=21.5`,
+			[]sample{
+				{name: "temperature", kind: sampleGauge, labels: map[string]string{}, value: 21.5},
+			},
+		},
+		"kind from rules": {
+			`requests,path=/api count=17u,errors_total=2i`,
+			[]sample{
+				{name: "requests_count", kind: sampleCounter, labels: map[string]string{"path": "/api"}, value: 17},
+				{name: "requests_errors_total", kind: sampleCounter, labels: map[string]string{"path": "/api"}, value: 2},
+			},
+		},
+		"booleans and strings": {
+			`switch,room=hall on=true,broken=F,label="main, left" 1465839830`,
+			[]sample{
+				{name: "switch_on", kind: sampleGauge, labels: map[string]string{"room": "hall"}, value: 1},
+				{name: "switch_broken", kind: sampleGauge, labels: map[string]string{"room": "hall"}, value: 0},
+			},
+		},
+		"escaped characters": {
+			`disk\ io,mount\=point=/var\,log,__name__=x bytes\ read=10`,
+			[]sample{
+				{name: "disk_io_bytes_read", kind: sampleGauge, labels: map[string]string{"mount_point": "/var,log"}, value: 10},
+			},
+		},
+		"comments and negative counters skipped": {
+			`# comment
+jobs_total value=-1
+cpu usage=1`,
+			[]sample{
+				{name: "cpu_usage", kind: sampleGauge, labels: map[string]string{}, value: 1},
+			},
+		},
+	}
+
+	for k, tc := range cases {
+		got, err := format.parse(strings.NewReader(tc.in))
+		if !a.NoError(t, err, k) {
+			continue
+		}
+
+		if !a.Len(t, got, len(tc.exp), k) {
+			continue
+		}
+		for i := range tc.exp {
+			a.Equal(t, tc.exp[i], *got[i], k)
+		}
+	}
+}
+
+func Test_InfluxParser_Parse_Errors(t *testing.T) {
+	got, err := newInfluxFormat(nil).parse(strings.NewReader(`cpu
+cpu usage=
+,host=a usage=1
+cpu,host usage=1
+cpu usage=abc
+cpu usage=1 notatimestamp
+cpu usage=1 1 2
+cpu usage=1`))
+
+	if a.Len(t, got, 1) {
+		a.Equal(t, "cpu_usage", got[0].name)
+	}
+
+	invalid, ok := err.(batchErrors)
+	if !a.True(t, ok, "batch errors expected") {
+		return
+	}
+	exp := []parseErrorReason{
+		parseErrorMalformed, parseErrorBadValue, parseErrorBadName, parseErrorBadLabel,
+		parseErrorBadValue, parseErrorBadTimestamp, parseErrorMalformed,
+	}
+	if a.Len(t, invalid, len(exp)) {
+		for i, reason := range exp {
+			a.Equal(t, reason, invalid[i].Reason, invalid[i].Error())
+			a.Equal(t, i+1, invalid[i].Line)
+		}
+	}
+}
+
+func Test_ParseKindRules_Invalid(t *testing.T) {
+	cases := map[string][]string{
+		"no separator":   {"_total$"},
+		"invalid kind":   {"h:_seconds$"},
+		"invalid regexp": {"c:(_total"},
+	}
+
+	for k, defs := range cases {
+		_, err := parseKindRules(defs)
+		a.Error(t, err, k)
+	}
+}
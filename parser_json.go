@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// histogramMaxBuckets limits number of histogram buckets defined by single sample.
+	histogramMaxBuckets = 1000
+)
+
+// formatJSON is JSON document holding batch of samples.
+//
+// Document is either an array of samples or an object with shared labels and an array of samples:
+//
+//	{"labels": {"service": "srvA1"}, "samples": [{"name": "requests_total", "type": "c", "value": 1}]}
+//
+// Sample types and histogram buckets have the same meaning as in the native format.
+// Invalid samples are skipped and reported with batchErrors, valid ones are returned anyway.
+var formatJSON = &sampleFormat{
+	name:  "json",
+	parse: parseJSON,
+}
+
+// jsonBatch is JSON document with shared labels.
+type jsonBatch struct {
+	Labels  map[string]string `json:"labels"`
+	Samples []json.RawMessage `json:"samples"`
+}
+
+// jsonSample is a single sample of JSON document.
+type jsonSample struct {
+	Name   string            `json:"name"`
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels"`
+	Value  *float64          `json:"value"`
+
+	// Buckets are upper bounds of histogram buckets for "h" type,
+	// start, width and count of buckets for "hl" type,
+	// start, factor and count of buckets for "he" type
+	// and optional bucket factor for "hn" type.
+	Buckets []float64 `json:"buckets"`
+}
+
+// parseJSON converts JSON document to samples.
+// Error is returned when document is malformed, batchErrors when only some of the samples are invalid.
+func parseJSON(r io.Reader) ([]*sample, error) {
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var batch jsonBatch
+	if body = bytes.TrimSpace(body); len(body) > 0 && body[0] == '[' {
+		err = json.Unmarshal(body, &batch.Samples)
+	} else {
+		err = json.Unmarshal(body, &batch)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding JSON document")
+	}
+
+	for name := range batch.Labels {
+		if err := validateLabelName(name); err != nil {
+			return nil, errors.Wrap(err, "shared labels")
+		}
+	}
+
+	var (
+		out     []*sample
+		invalid batchErrors
+	)
+	for i, raw := range batch.Samples {
+		s, err := parseJSONSample(raw, batch.Labels)
+		if err != nil {
+			err.Index = i
+			invalid = append(invalid, err)
+			continue
+		}
+		out = append(out, s)
+	}
+
+	if len(invalid) > 0 {
+		return out, invalid
+	}
+	return out, nil
+}
+
+// parseJSONSample decodes and validates single sample. Labels of the sample override shared ones.
+func parseJSONSample(raw json.RawMessage, sharedLabels map[string]string) (*sample, *parseError) {
+	var js jsonSample
+	if err := json.Unmarshal(raw, &js); err != nil {
+		return nil, newParseError(parseErrorMalformed, "%s", err)
+	}
+
+	if !metricNameRE.MatchString(js.Name) {
+		return nil, newParseError(parseErrorBadName, "invalid name %q", js.Name)
+	}
+	if js.Value == nil {
+		return nil, newParseError(parseErrorBadValue, "missing value")
+	}
+
+	s := &sample{
+		name:   js.Name,
+		kind:   sampleKindMapper(js.Type),
+		labels: make(map[string]string, len(sharedLabels)+len(js.Labels)),
+		value:  *js.Value,
+	}
+	if s.kind == sampleUnknown {
+		s.kind, s.gaugeOp = gaugeOpMapper(js.Type)
+	}
+	for k, v := range sharedLabels {
+		s.labels[k] = v
+	}
+	for k, v := range js.Labels {
+		if err := validateLabelName(k); err != nil {
+			return nil, err
+		}
+		s.labels[k] = v
+	}
+
+	switch s.kind {
+	case sampleCounter, sampleGauge:
+		if len(js.Buckets) > 0 {
+			return nil, newParseError(parseErrorBadHistogramDef, "buckets not allowed for type %q", js.Type)
+		}
+		if s.kind == sampleCounter && s.value < 0 {
+			return nil, newParseError(parseErrorBadValue, "negative counter value")
+		}
+
+	case sampleHistogram:
+		if len(js.Buckets) > histogramMaxBuckets {
+			return nil, newParseError(parseErrorBadHistogramDef, "more than %d buckets", histogramMaxBuckets)
+		}
+		for i := 1; i < len(js.Buckets); i++ {
+			if js.Buckets[i] <= js.Buckets[i-1] {
+				return nil, newParseError(parseErrorBadHistogramDef, "buckets not in increasing order")
+			}
+		}
+		s.histogramDef = formatBuckets(js.Buckets)
+
+	case sampleHistogramLinear:
+		if len(js.Buckets) != 3 {
+			return nil, newParseError(parseErrorBadHistogramDef, "expected start, width and count of buckets")
+		}
+		if err := linearBucketsError(js.Buckets[0], js.Buckets[1], js.Buckets[2]); err != nil {
+			return nil, err
+		}
+		s.histogramDef = append(formatBuckets(js.Buckets[:2]), strconv.Itoa(int(js.Buckets[2])))
+
+	case sampleHistogramExponential:
+		if len(js.Buckets) != 3 {
+			return nil, newParseError(parseErrorBadHistogramDef, "expected start, factor and count of buckets")
+		}
+		if err := exponentialBucketsError(js.Buckets[0], js.Buckets[1], js.Buckets[2]); err != nil {
+			return nil, err
+		}
+		s.histogramDef = append(formatBuckets(js.Buckets[:2]), strconv.Itoa(int(js.Buckets[2])))
+
+	case sampleHistogramNative:
+		if len(js.Buckets) > 1 {
+			return nil, newParseError(parseErrorBadHistogramDef, "expected bucket factor")
+		}
+		for _, factor := range js.Buckets {
+			if err := nativeFactorError(factor); err != nil {
+				return nil, err
+			}
+		}
+		s.histogramDef = formatBuckets(js.Buckets)
+
+	case sampleSummary, sampleSet:
+		return nil, newParseError(parseErrorBadKind, "type %q not supported", js.Type)
+
+	default:
+		return nil, newParseError(parseErrorBadKind, "unknown type %q", js.Type)
+	}
+
+	if pe := s.reservedLabelError(); pe != nil {
+		return nil, pe
+	}
+
+	return s, nil
+}
+
+// validateLabelName checks if name can be used as label name.
+func validateLabelName(name string) *parseError {
+	if !labelNameRE.MatchString(name) || strings.HasPrefix(name, reservedLabelPrefix) {
+		return newParseError(parseErrorBadLabel, "invalid label name %q", name)
+	}
+	return nil
+}
+
+// formatBuckets converts buckets to histogram definition, as parsed from native format.
+func formatBuckets(buckets []float64) []string {
+	out := make([]string, len(buckets))
+	for i, b := range buckets {
+		out[i] = strconv.FormatFloat(b, 'g', -1, 64)
+	}
+	return out
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	a "github.com/stretchr/testify/assert"
+)
+
+func Test_JSONParser_Parse_Success(t *testing.T) {
+	cases := map[string]struct {
+		in  string
+		exp []sample
+	}{
+		"array": {
+			`[
+				{"name": "name_of_1_metric_total", "type": "c", "labels": {"labelA": "labelValueA"}, "value": 12.345},
+				{"name": "name_of_2_metric", "type": "g", "value": -56}
+			]`,
+			[]sample{
+				{name: "name_of_1_metric_total", kind: sampleCounter, labels: map[string]string{"labelA": "labelValueA"}, value: 12.345},
+				{name: "name_of_2_metric", kind: sampleGauge, labels: map[string]string{}, value: -56},
+			},
+		},
+		"gauge changes": {
+			`[
+				{"name": "name_of_2_metric", "type": "g+", "value": 2},
+				{"name": "name_of_2_metric", "type": "g-", "value": 1.5}
+			]`,
+			[]sample{
+				{name: "name_of_2_metric", kind: sampleGauge, labels: map[string]string{}, value: 2, gaugeOp: gaugeOpAdd},
+				{name: "name_of_2_metric", kind: sampleGauge, labels: map[string]string{}, value: 1.5, gaugeOp: gaugeOpSub},
+			},
+		},
+		"shared labels": {
+			`{"labels": {"service": "srvA1", "host": "hostA"}, "samples": [
+				{"name": "name_of_1_metric_total", "type": "c", "labels": {"host": "hostB"}, "value": 1}
+			]}`,
+			[]sample{
+				{name: "name_of_1_metric_total", kind: sampleCounter, labels: map[string]string{"service": "srvA1", "host": "hostB"}, value: 1},
+			},
+		},
+		"histograms": {
+			`[
+				{"name": "name_of_1_metric_seconds", "type": "h", "buckets": [0.1, 0.5, 1], "value": 0.3},
+				{"name": "name_of_2_metric_seconds", "type": "h", "value": 0.3},
+				{"name": "name_of_3_metric_seconds", "type": "hl", "buckets": [0.5, 0.25, 4], "value": 0.7},
+				{"name": "name_of_4_metric_seconds", "type": "he", "buckets": [0.001, 2, 16], "value": 0.7},
+				{"name": "name_of_5_metric_seconds", "type": "hn", "buckets": [1.05], "value": 0.7}
+			]`,
+			[]sample{
+				{name: "name_of_1_metric_seconds", kind: sampleHistogram, labels: map[string]string{}, value: 0.3, histogramDef: []string{"0.1", "0.5", "1"}},
+				{name: "name_of_2_metric_seconds", kind: sampleHistogram, labels: map[string]string{}, value: 0.3, histogramDef: []string{}},
+				{name: "name_of_3_metric_seconds", kind: sampleHistogramLinear, labels: map[string]string{}, value: 0.7, histogramDef: []string{"0.5", "0.25", "4"}},
+				{name: "name_of_4_metric_seconds", kind: sampleHistogramExponential, labels: map[string]string{}, value: 0.7, histogramDef: []string{"0.001", "2", "16"}},
+				{name: "name_of_5_metric_seconds", kind: sampleHistogramNative, labels: map[string]string{}, value: 0.7, histogramDef: []string{"1.05"}},
+			},
+		},
+	}
+
+	for k, tc := range cases {
+		got, err := formatJSON.parse(strings.NewReader(tc.in))
+		if !a.NoError(t, err, k) {
+			continue
+		}
+
+		if !a.Len(t, got, len(tc.exp), k) {
+			continue
+		}
+		for i := range tc.exp {
+			a.Equal(t, tc.exp[i], *got[i], k)
+		}
+	}
+}
+
+func Test_JSONParser_Parse_InvalidElements(t *testing.T) {
+	in := `[
+		{"name": "name_of_1_metric_total", "type": "c", "value": 1},
+		{"name": "name_of_1_metric_total", "type": "c", "value": -1},
+		{"name": "name.of.2", "type": "g", "value": 1},
+		{"name": "name_of_2_metric", "type": "g"},
+		{"name": "name_of_2_metric", "type": "g", "value": "1"},
+		{"name": "name_of_2_metric", "type": "x", "value": 1},
+		{"name": "name_of_2_metric", "type": "g", "labels": {"__name__": "x"}, "value": 1},
+		{"name": "name_of_2_metric", "type": "g", "buckets": [1], "value": 1},
+		{"name": "name_of_3_metric", "type": "h", "buckets": [1, 1], "value": 1},
+		{"name": "name_of_3_metric", "type": "h", "labels": {"le": "1"}, "value": 1},
+		{"name": "name_of_3_metric", "type": "hl", "buckets": [1, 1], "value": 1},
+		{"name": "name_of_3_metric", "type": "hl", "buckets": [1, 1, 1.5], "value": 1},
+		{"name": "name_of_3_metric", "type": "hl", "buckets": [1, 0, 3], "value": 1},
+		{"name": "name_of_3_metric", "type": "he", "buckets": [1, 2], "value": 1},
+		{"name": "name_of_3_metric", "type": "he", "buckets": [1, 0.5, 3], "value": 1},
+		{"name": "name_of_3_metric", "type": "hn", "buckets": [0.5], "value": 1},
+		{"name": "name_of_4_metric", "type": "s", "value": 1},
+		{"name": "name_of_4_metric", "type": "u", "value": 1},
+		{"name": "name_of_2_metric", "type": "g", "value": 2}
+	]`
+
+	got, err := formatJSON.parse(strings.NewReader(in))
+
+	if a.Len(t, got, 2) {
+		a.Equal(t, 1.0, got[0].value)
+		a.Equal(t, 2.0, got[1].value)
+	}
+
+	invalid, ok := err.(batchErrors)
+	if a.True(t, ok, "batchErrors expected, got: %v", err) {
+		var indexes []int
+		for _, e := range invalid {
+			indexes = append(indexes, e.Index)
+			a.NotEmpty(t, e.Message)
+		}
+		a.Equal(t, []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17}, indexes)
+		if len(invalid) == 17 {
+			a.Equal(t, `type "s" not supported`, invalid[15].Message)
+			a.Equal(t, parseErrorBadKind, invalid[15].Reason)
+			a.Equal(t, `type "u" not supported`, invalid[16].Message)
+		}
+	}
+}
+
+func Test_JSONParser_Parse_Malformed(t *testing.T) {
+	cases := map[string]string{
+		"syntax":               `[{"name": "name_of_1_metric_total"`,
+		"not array":            `"name_of_1_metric_total"`,
+		"invalid shared label": `{"labels": {"1abc": "x"}, "samples": []}`,
+	}
+
+	for k, in := range cases {
+		got, err := formatJSON.parse(strings.NewReader(in))
+		a.Error(t, err, k)
+		_, isBatchErrors := err.(batchErrors)
+		a.False(t, isBatchErrors, k)
+		a.Empty(t, got, k)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// otlpFormat converts OTLP metrics export requests in protobuf encoding to samples.
+//
+// Sums are mapped to counters when monotonic and to gauges otherwise.
+// Gauges are mapped to gauges. Explicit bucket histograms are merged bucket by bucket into aggregated histogram.
+// Cumulative values are converted to increases since the previous export of the series, so exports
+// of many short-lived processes can be aggregated. Delta values are applied as they are.
+// Exponential histograms and summaries are not supported and skipped.
+//
+// Resource attributes and data point attributes are mapped to labels, the latter take precedence.
+// Names are sanitized the same way as StatsD ones.
+type otlpFormat struct {
+	cumulative *cumulativeTracker
+}
+
+// newOTLPFormat creates OTLP format. Cumulative values are tracked by cumulative.
+func newOTLPFormat(cumulative *cumulativeTracker) *sampleFormat {
+	f := &otlpFormat{cumulative: cumulative}
+	return &sampleFormat{
+		name:  "otlp",
+		parse: f.parse,
+	}
+}
+
+// parse converts whole export request to samples.
+func (f *otlpFormat) parse(r io.Reader) ([]*sample, error) {
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &colmetricspb.ExportMetricsServiceRequest{}
+	if err := proto.Unmarshal(body, req); err != nil {
+		return nil, errors.Wrap(err, "decoding OTLP request")
+	}
+
+	var out []*sample
+	for _, rm := range req.GetResourceMetrics() {
+		resourceLabels := otlpLabels(rm.GetResource().GetAttributes(), nil)
+		for _, sm := range rm.GetScopeMetrics() {
+			for _, m := range sm.GetMetrics() {
+				out = f.appendMetric(out, m, resourceLabels)
+			}
+		}
+	}
+	return out, nil
+}
+
+// appendMetric converts data points of the metric to samples and appends them to out.
+func (f *otlpFormat) appendMetric(out []*sample, m *metricspb.Metric, resourceLabels map[string]string) []*sample {
+	name := sanitizeMetricName(m.GetName())
+	if name == "" {
+		return out
+	}
+
+	switch data := m.GetData().(type) {
+	case *metricspb.Metric_Gauge:
+		for _, p := range data.Gauge.GetDataPoints() {
+			if s := otlpNumberSample(name, sampleGauge, p, resourceLabels); s != nil {
+				out = append(out, s)
+			}
+		}
+
+	case *metricspb.Metric_Sum:
+		temporality := data.Sum.GetAggregationTemporality()
+		monotonic := data.Sum.GetIsMonotonic()
+		for _, p := range data.Sum.GetDataPoints() {
+			if s := f.sumSample(name, temporality, monotonic, p, resourceLabels); s != nil {
+				out = append(out, s)
+			}
+		}
+
+	case *metricspb.Metric_Histogram:
+		temporality := data.Histogram.GetAggregationTemporality()
+		for _, p := range data.Histogram.GetDataPoints() {
+			if s := f.histogramSample(name, temporality, p, resourceLabels); s != nil {
+				out = append(out, s)
+			}
+		}
+	}
+
+	return out
+}
+
+// sumSample converts data point of the sum to counter or gauge sample. It returns nil for invalid points.
+func (f *otlpFormat) sumSample(name string, temporality metricspb.AggregationTemporality, monotonic bool, p *metricspb.NumberDataPoint, resourceLabels map[string]string) *sample {
+	kind := sampleGauge
+	if monotonic {
+		kind = sampleCounter
+	}
+
+	s := otlpNumberSample(name, kind, p, resourceLabels)
+	if s == nil {
+		return nil
+	}
+
+	switch temporality {
+	case metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE:
+		if monotonic {
+			s.value = f.cumulative.counterDelta(otlpCumulativeKey(s, p.GetStartTimeUnixNano()), p.GetStartTimeUnixNano(), s.value)
+		}
+
+	case metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA:
+		if !monotonic {
+			s.gaugeOp = gaugeOpAdd
+			if s.value < 0 {
+				s.gaugeOp = gaugeOpSub
+				s.value = -s.value
+			}
+		}
+
+	default:
+		return nil
+	}
+
+	if s.kind == sampleCounter && s.value < 0 {
+		return nil
+	}
+	return s
+}
+
+// otlpCumulativeKey returns key of cumulative series of the sample started at start.
+// Short-lived processes often export series with the same labels, start time tells them apart.
+func otlpCumulativeKey(s *sample, start uint64) string {
+	return cumulativeKey(s.hash(), strconv.FormatUint(start, 10))
+}
+
+// histogramSample converts data point of the histogram to sample. It returns nil for invalid points.
+func (f *otlpFormat) histogramSample(name string, temporality metricspb.AggregationTemporality, p *metricspb.HistogramDataPoint, resourceLabels map[string]string) *sample {
+	if p.GetFlags()&uint32(metricspb.DataPointFlags_DATA_POINT_FLAGS_NO_RECORDED_VALUE_MASK) != 0 {
+		return nil
+	}
+
+	// bucket counts are not cumulative and hold additional overflow bucket for +Inf
+	bounds := p.GetExplicitBounds()
+	bucketCounts := p.GetBucketCounts()
+	if len(bucketCounts) == 0 && len(bounds) != 0 || len(bucketCounts) != 0 && len(bucketCounts) != len(bounds)+1 {
+		return nil
+	}
+	if !sort.Float64sAreSorted(bounds) {
+		return nil
+	}
+
+	d := &histogramData{
+		upperBounds: bounds,
+		counts:      make([]uint64, len(bounds)),
+		count:       p.GetCount(),
+		sum:         p.GetSum(),
+	}
+	var cumulativeCount uint64
+	for i := range bounds {
+		cumulativeCount += bucketCounts[i]
+		d.counts[i] = cumulativeCount
+	}
+
+	s := &sample{
+		name:   name,
+		kind:   sampleHistogramMerged,
+		labels: otlpLabels(p.GetAttributes(), resourceLabels),
+	}
+
+	switch temporality {
+	case metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE:
+		s.histogram = f.cumulative.histogramDelta(otlpCumulativeKey(s, p.GetStartTimeUnixNano()), p.GetStartTimeUnixNano(), d)
+	case metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA:
+		s.histogram = d
+	default:
+		return nil
+	}
+
+	return s
+}
+
+// otlpNumberSample converts number data point to sample of given kind. It returns nil for points without value.
+func otlpNumberSample(name string, kind sampleKind, p *metricspb.NumberDataPoint, resourceLabels map[string]string) *sample {
+	if p.GetFlags()&uint32(metricspb.DataPointFlags_DATA_POINT_FLAGS_NO_RECORDED_VALUE_MASK) != 0 {
+		return nil
+	}
+
+	s := &sample{
+		name:   name,
+		kind:   kind,
+		labels: otlpLabels(p.GetAttributes(), resourceLabels),
+	}
+
+	switch v := p.GetValue().(type) {
+	case *metricspb.NumberDataPoint_AsDouble:
+		s.value = v.AsDouble
+	case *metricspb.NumberDataPoint_AsInt:
+		s.value = float64(v.AsInt)
+	default:
+		return nil
+	}
+
+	return s
+}
+
+// otlpLabels converts attributes to labels, adding them to a copy of base.
+// Attributes with array, map or bytes values can not be represented as label and are skipped.
+func otlpLabels(attrs []*commonpb.KeyValue, base map[string]string) map[string]string {
+	labels := make(map[string]string, len(base)+len(attrs))
+	for k, v := range base {
+		labels[k] = v
+	}
+
+	for _, kv := range attrs {
+		name := sanitizeLabelName(kv.GetKey())
+		if name == "" || strings.HasPrefix(name, reservedLabelPrefix) {
+			continue
+		}
+
+		switch v := kv.GetValue().GetValue().(type) {
+		case *commonpb.AnyValue_StringValue:
+			labels[name] = v.StringValue
+		case *commonpb.AnyValue_BoolValue:
+			labels[name] = strconv.FormatBool(v.BoolValue)
+		case *commonpb.AnyValue_IntValue:
+			labels[name] = strconv.FormatInt(v.IntValue, 10)
+		case *commonpb.AnyValue_DoubleValue:
+			labels[name] = strconv.FormatFloat(v.DoubleValue, 'g', -1, 64)
+		}
+	}
+	return labels
+}
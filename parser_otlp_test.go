@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/protobuf/proto"
+
+	a "github.com/stretchr/testify/assert"
+)
+
+const (
+	tfOTLPCumulative = metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE
+	tfOTLPDelta      = metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA
+)
+
+// thOTLPRequest encodes export request with single resource holding metrics.
+func thOTLPRequest(t *testing.T, metrics ...*metricspb.Metric) []byte {
+	req := &colmetricspb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricspb.ResourceMetrics{{
+			Resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{
+				thOTLPAttr("service.name", "srvA1"),
+				thOTLPAttr("host", "hostA"),
+			}},
+			ScopeMetrics: []*metricspb.ScopeMetrics{{Metrics: metrics}},
+		}},
+	}
+	body, err := proto.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+// thOTLPAttr creates attribute with string, int64 or bool value.
+func thOTLPAttr(key string, v interface{}) *commonpb.KeyValue {
+	av := &commonpb.AnyValue{}
+	switch v := v.(type) {
+	case string:
+		av.Value = &commonpb.AnyValue_StringValue{StringValue: v}
+	case int64:
+		av.Value = &commonpb.AnyValue_IntValue{IntValue: v}
+	case bool:
+		av.Value = &commonpb.AnyValue_BoolValue{BoolValue: v}
+	}
+	return &commonpb.KeyValue{Key: key, Value: av}
+}
+
+func thOTLPSum(name string, temporality metricspb.AggregationTemporality, monotonic bool, points ...*metricspb.NumberDataPoint) *metricspb.Metric {
+	return &metricspb.Metric{Name: name, Data: &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+		AggregationTemporality: temporality, IsMonotonic: monotonic, DataPoints: points,
+	}}}
+}
+
+func thOTLPPoint(v float64, attrs ...*commonpb.KeyValue) *metricspb.NumberDataPoint {
+	return &metricspb.NumberDataPoint{StartTimeUnixNano: 100, Attributes: attrs, Value: &metricspb.NumberDataPoint_AsDouble{AsDouble: v}}
+}
+
+func Test_OTLPParser_Parse_Success(t *testing.T) {
+	defer thInitSampleHasher(hashMD5)()
+
+	resourceLabels := map[string]string{"service_name": "srvA1", "host": "hostA"}
+	withLabels := func(kv ...string) map[string]string {
+		out := map[string]string{"service_name": "srvA1", "host": "hostA"}
+		for i := 0; i < len(kv); i += 2 {
+			out[kv[i]] = kv[i+1]
+		}
+		return out
+	}
+
+	cases := map[string]struct {
+		in  *metricspb.Metric
+		exp []sample
+	}{
+		"cumulative counter": {
+			thOTLPSum("http.requests", tfOTLPCumulative, true,
+				thOTLPPoint(5, thOTLPAttr("code", int64(200)), thOTLPAttr("host", "hostB")),
+				&metricspb.NumberDataPoint{Value: &metricspb.NumberDataPoint_AsInt{AsInt: 3}},
+			),
+			[]sample{
+				{name: "http_requests", kind: sampleCounter, labels: withLabels("code", "200", "host", "hostB"), value: 5},
+				{name: "http_requests", kind: sampleCounter, labels: resourceLabels, value: 3},
+			},
+		},
+		"delta counter": {
+			thOTLPSum("jobs", tfOTLPDelta, true, thOTLPPoint(2), thOTLPPoint(-1)),
+			[]sample{
+				{name: "jobs", kind: sampleCounter, labels: resourceLabels, value: 2},
+			},
+		},
+		"up down counters": {
+			thOTLPSum("queue", tfOTLPDelta, false, thOTLPPoint(-2, thOTLPAttr("ok", true))),
+			[]sample{
+				{name: "queue", kind: sampleGauge, labels: withLabels("ok", "true"), value: 2, gaugeOp: gaugeOpSub},
+			},
+		},
+		"gauge": {
+			&metricspb.Metric{Name: "temperature", Data: &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{
+				DataPoints: []*metricspb.NumberDataPoint{
+					thOTLPPoint(21.5),
+					{Flags: uint32(metricspb.DataPointFlags_DATA_POINT_FLAGS_NO_RECORDED_VALUE_MASK)},
+				},
+			}}},
+			[]sample{
+				{name: "temperature", kind: sampleGauge, labels: resourceLabels, value: 21.5},
+			},
+		},
+		"histogram": {
+			&metricspb.Metric{Name: "duration", Data: &metricspb.Metric_Histogram{Histogram: &metricspb.Histogram{
+				AggregationTemporality: tfOTLPDelta,
+				DataPoints: []*metricspb.HistogramDataPoint{
+					{ExplicitBounds: []float64{0.1, 1}, BucketCounts: []uint64{1, 2, 1}, Count: 4, Sum: proto.Float64(3.5)},
+					{ExplicitBounds: []float64{0.1, 1}, BucketCounts: []uint64{1, 2}, Count: 3},
+				},
+			}}},
+			[]sample{
+				{
+					name: "duration", kind: sampleHistogramMerged, labels: resourceLabels,
+					histogram: &histogramData{upperBounds: []float64{0.1, 1}, counts: []uint64{1, 3}, count: 4, sum: 3.5},
+				},
+			},
+		},
+		"unspecified temporality skipped": {
+			thOTLPSum("jobs", metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_UNSPECIFIED, true, thOTLPPoint(2)),
+			nil,
+		},
+	}
+
+	for k, tc := range cases {
+		got, err := newOTLPFormat(newCumulativeTracker(time.Hour)).parse(bytes.NewReader(thOTLPRequest(t, tc.in)))
+		if !a.NoError(t, err, k) {
+			continue
+		}
+
+		if !a.Len(t, got, len(tc.exp), k) {
+			continue
+		}
+		for i := range tc.exp {
+			a.Equal(t, tc.exp[i], *got[i], k)
+		}
+	}
+}
+
+func Test_OTLPParser_Parse_CumulativeDelta(t *testing.T) {
+	defer thInitSampleHasher(hashMD5)()
+
+	format := newOTLPFormat(newCumulativeTracker(time.Hour))
+	var values []float64
+	for _, v := range []float64{5, 8, 8, 2} {
+		got, err := format.parse(bytes.NewReader(thOTLPRequest(t, thOTLPSum("jobs", tfOTLPCumulative, true, thOTLPPoint(v)))))
+		if a.NoError(t, err) && a.Len(t, got, 1) {
+			values = append(values, got[0].value)
+		}
+	}
+	a.Equal(t, []float64{5, 3, 0, 2}, values)
+}
+
+func Test_OTLPParser_Parse_CumulativeDelta_InterleavedStarts(t *testing.T) {
+	defer thInitSampleHasher(hashMD5)()
+
+	// two short-lived processes export the same series
+	format := newOTLPFormat(newCumulativeTracker(time.Hour))
+	points := []struct {
+		start uint64
+		value float64
+	}{{100, 5}, {200, 3}, {100, 8}, {200, 4}, {100, 9}}
+
+	var total float64
+	for _, pt := range points {
+		p := thOTLPPoint(pt.value)
+		p.StartTimeUnixNano = pt.start
+		got, err := format.parse(bytes.NewReader(thOTLPRequest(t, thOTLPSum("jobs", tfOTLPCumulative, true, p))))
+		if a.NoError(t, err) && a.Len(t, got, 1) {
+			a.Equal(t, map[string]string{"service_name": "srvA1", "host": "hostA"}, got[0].labels)
+			total += got[0].value
+		}
+	}
+	a.Equal(t, 9.0+4.0, total)
+}
+
+func Test_OTLPParser_Parse_Malformed(t *testing.T) {
+	_, err := newOTLPFormat(newCumulativeTracker(time.Hour)).parse(bytes.NewReader([]byte{0xff, 0xff}))
+	a.Error(t, err)
+}
+
+func Test_Server_OTLPMetricsHandler(t *testing.T) {
+	defer thInitSampleHasher(hashMD5)()
+
+	body := thOTLPRequest(t, thOTLPSum("jobs", tfOTLPDelta, true, thOTLPPoint(2), thOTLPPoint(3)))
+	cases := map[string]struct {
+		contentType string
+		handlerErr  error
+		expStatus   int
+		expRejected int64
+	}{
+		"accepted":             {otlpContentType, nil, http.StatusOK, 0},
+		"queue full":           {otlpContentType, ErrIngressQueueFull, http.StatusOK, 2},
+		"unsupported encoding": {"application/json", nil, http.StatusUnsupportedMediaType, 0},
+	}
+
+	for k, tc := range cases {
+		func() {
+			defer thInitRegistry()()
+
+			s := newServer(func(*sample) error { return tc.handlerErr }, 1024)
+
+			r := httptest.NewRequest(http.MethodPost, "/v1/metrics", bytes.NewReader(body))
+			r.Header.Set("Content-Type", tc.contentType)
+			w := httptest.NewRecorder()
+			s.otlpMetricsHandler(1024, newOTLPFormat(newCumulativeTracker(time.Hour)))(w, r)
+
+			a.Equal(t, tc.expStatus, w.Code, k)
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			resp := &colmetricspb.ExportMetricsServiceResponse{}
+			a.NoError(t, proto.Unmarshal(w.Body.Bytes(), resp), k)
+			a.Equal(t, tc.expRejected, resp.GetPartialSuccess().GetRejectedDataPoints(), k)
+		}()
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// formatPrometheus is Prometheus text exposition format, as exposed by client libraries.
+//
+// It's a document format, whole batch is parsed at once, so it can not be streamed over TCP.
+// Counters are mapped to counters, so pushed value is added to the aggregated one.
+// Gauges and untyped metrics are mapped to gauges.
+// Histograms are merged bucket by bucket into aggregated histogram.
+// Summaries are not supported and skipped. Timestamps are ignored.
+var formatPrometheus = &sampleFormat{
+	name:  "prometheus",
+	parse: parsePrometheusText,
+}
+
+// parsePrometheusText converts metric families in Prometheus text format to samples.
+// Error is returned if the text is malformed, no samples are returned in such case.
+func parsePrometheusText(r io.Reader) ([]*sample, error) {
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []*sample
+	for name, family := range families {
+		for _, m := range family.GetMetric() {
+			if s := prometheusSample(name, family.GetType(), m); s != nil {
+				out = append(out, s)
+			}
+		}
+	}
+	return out, nil
+}
+
+// prometheusSample converts single metric to sample. It returns nil for metrics which are not supported.
+func prometheusSample(name string, typ dto.MetricType, m *dto.Metric) *sample {
+	s := &sample{
+		name:   name,
+		labels: make(map[string]string, len(m.GetLabel())),
+	}
+	for _, l := range m.GetLabel() {
+		s.labels[l.GetName()] = l.GetValue()
+	}
+
+	switch typ {
+	case dto.MetricType_COUNTER:
+		s.kind = sampleCounter
+		s.value = m.GetCounter().GetValue()
+		if !(s.value >= 0) {
+			return nil
+		}
+
+	case dto.MetricType_GAUGE:
+		s.kind = sampleGauge
+		s.value = m.GetGauge().GetValue()
+
+	case dto.MetricType_UNTYPED:
+		s.kind = sampleGauge
+		s.value = m.GetUntyped().GetValue()
+
+	case dto.MetricType_HISTOGRAM:
+		h := m.GetHistogram()
+		s.kind = sampleHistogramMerged
+		s.histogram = histogramDataFromBuckets(h.GetSampleCount(), h.GetSampleSum(), h.GetBucket())
+
+	default:
+		return nil
+	}
+
+	return s
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	a "github.com/stretchr/testify/assert"
+)
+
+func Test_PrometheusParser_Parse_Success(t *testing.T) {
+	in := `# HELP jobs_processed_total Number of processed jobs.
+# TYPE jobs_processed_total counter
+jobs_processed_total{queue="mail"} 12
+jobs_processed_total{queue="sms"} -1
+# TYPE jobs_queue_length gauge
+jobs_queue_length 3.5
+jobs_last_run_timestamp_seconds 1.5e9
+# TYPE job_duration_seconds histogram
+job_duration_seconds_bucket{le="0.1"} 1
+job_duration_seconds_bucket{le="1"} 3
+job_duration_seconds_bucket{le="+Inf"} 4
+job_duration_seconds_sum 7.2
+job_duration_seconds_count 4
+# TYPE job_size_bytes summary
+job_size_bytes{quantile="0.5"} 1024
+job_size_bytes_sum 4096
+job_size_bytes_count 4
+`
+
+	exp := []sample{
+		{
+			name: "job_duration_seconds", kind: sampleHistogramMerged, labels: map[string]string{},
+			histogram: &histogramData{upperBounds: []float64{0.1, 1}, counts: []uint64{1, 3}, count: 4, sum: 7.2},
+		},
+		{name: "jobs_last_run_timestamp_seconds", kind: sampleGauge, labels: map[string]string{}, value: 1.5e9},
+		{name: "jobs_processed_total", kind: sampleCounter, labels: map[string]string{"queue": "mail"}, value: 12},
+		{name: "jobs_queue_length", kind: sampleGauge, labels: map[string]string{}, value: 3.5},
+	}
+
+	got, err := formatPrometheus.parse(strings.NewReader(in))
+	if !a.NoError(t, err) {
+		return
+	}
+
+	// families are returned in random order
+	sort.Slice(got, func(i, j int) bool { return got[i].name < got[j].name })
+	if a.Len(t, got, len(exp)) {
+		for i := range exp {
+			a.Equal(t, exp[i], *got[i])
+		}
+	}
+}
+
+func Test_PrometheusParser_Parse_Malformed(t *testing.T) {
+	got, err := formatPrometheus.parse(strings.NewReader("jobs_queue_length 3\njobs_queue_length{ 3\n"))
+	a.Error(t, err)
+	a.Empty(t, got)
+}
@@ -0,0 +1,297 @@
+package main
+
+// Reference implementation of the native format parser, based on regular expressions.
+// It was replaced by hand-written parser and is kept to prove, that both accept
+// and reject the same lines.
+
+import (
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// label value is either quoted (may be empty, contain separators and backslash escapes) or not
+	labelValueREPart         = `("(?:[^"\\]|\\.)*"|[^;|]+)`
+	labelWithValueREPart     = labelNameREPart + sampleParserLabelFromValueSeparator + labelValueREPart
+	sampleParserLabelsREPart = `(` + labelWithValueREPart + `(` + sampleParserLabelsSeparator + labelWithValueREPart + `)*)`
+
+	regexpSharedLabelsLineRE = regexp.MustCompile(`^` + sampleParserLabelsREPart + `$`)
+
+	sampleKindREPart         = `(c|g|hl|h)`
+	sampleHistogramDefREPart = `[0-9.]+(;[0-9.]+)*`
+	// value is validated with strconv.ParseFloat, so negative, scientific notation, Inf and NaN are accepted
+	sampleValueREPart            = `[^|]+`
+	sampleParserSampleLineREPart = `^` +
+		metricNameREPart + `\|` +
+		sampleKindREPart + `\|` +
+		`(` + sampleHistogramDefREPart + `\|)?` + // optional
+		`(` + sampleParserLabelsREPart + `\|)?` + // optional
+		sampleValueREPart +
+		`$`
+	regexpHistogramDefRE = regexp.MustCompile(`^` + sampleHistogramDefREPart + `$`)
+	regexpSampleLineRE   = regexp.MustCompile(sampleParserSampleLineREPart)
+)
+
+// regexpLineParser converts consecutive lines of a single batch to samples.
+// It keeps the state of the batch (like shared labels) between lines.
+type regexpLineParser struct {
+	state        sampleParserState
+	sharedLabels map[string]string
+}
+
+// newRegexpLineParser creates parser for a new batch of lines.
+func newRegexpLineParser() *regexpLineParser {
+	return &regexpLineParser{
+		state:        sampleParserStateSearching,
+		sharedLabels: make(map[string]string),
+	}
+}
+
+// parseSampleRegexp parses the batch with reference parser.
+func parseSampleRegexp(r io.Reader) ([]*sample, error) {
+	return parseLines(r, newRegexpLineParser())
+}
+
+// parseLine implements lineParser.
+// Empty lines are skipped silently, other invalid lines are explained with *parseError.
+func (p *regexpLineParser) parseLine(text string, out []*sample) ([]*sample, error) {
+	if text == "" {
+		return out, nil
+	}
+
+	switch p.state {
+	case sampleParserStateSearching:
+		if regexpSharedLabelsLineRE.MatchString(text) {
+			p.sharedLabels = make(map[string]string) // reset
+			regexpSampleLabelsMapper(text, p.sharedLabels)
+			p.state = sampleParserStateSample
+			return out, nil
+		}
+
+	case sampleParserStateSample:
+		if regexpSharedLabelsLineRE.MatchString(text) {
+			return out, newParseError(parseErrorMisplacedSharedLabels, "shared labels allowed only once, before samples")
+		}
+	}
+
+	if !regexpIsSampleLine(text) {
+		return out, regexpExplainSampleLine(text)
+	}
+
+	s, err := regexpParseSampleLine(text, p.sharedLabels)
+	if err != nil {
+		return out, err
+	}
+	return append(out, s), nil
+}
+
+// regexpExplainSampleLine finds the reason why text is not a valid sample line.
+func regexpExplainSampleLine(text string) *parseError {
+	parts := regexpSplitSampleLine(text, sampleParserSamplePartsSeparator[0])
+	if len(parts) < 3 {
+		return newParseError(parseErrorMalformed, "expected name, kind and value separated with %q", sampleParserSamplePartsSeparator)
+	}
+
+	if !metricNameRE.MatchString(parts[0]) {
+		return newParseError(parseErrorBadName, "invalid metric name %q", parts[0])
+	}
+
+	kind := sampleKindMapper(parts[1])
+	if kind == sampleUnknown {
+		return newParseError(parseErrorBadKind, "unknown kind %q", parts[1])
+	}
+
+	if value := parts[len(parts)-1]; !regexpIsSampleValue(value) {
+		return newParseError(parseErrorBadValue, "invalid value %q", value)
+	}
+
+	isHistogram := kind == sampleHistogram || kind == sampleHistogramLinear
+	middle := parts[2 : len(parts)-1]
+	switch {
+	case len(middle) > 2 || len(middle) == 2 && !isHistogram:
+		return newParseError(parseErrorMalformed, "too many parts")
+
+	case len(middle) == 2:
+		if !regexpIsHistogramDef(middle[0]) {
+			return newParseError(parseErrorBadHistogramDef, "invalid histogram definition %q", middle[0])
+		}
+		if !regexpSharedLabelsLineRE.MatchString(middle[1]) {
+			return newParseError(parseErrorBadLabel, "invalid labels %q", middle[1])
+		}
+
+	case len(middle) == 1:
+		if isHistogram && regexpIsHistogramDef(middle[0]) {
+			break
+		}
+		if !regexpSharedLabelsLineRE.MatchString(middle[0]) {
+			if isHistogram && !strings.Contains(middle[0], sampleParserLabelFromValueSeparator) {
+				return newParseError(parseErrorBadHistogramDef, "invalid histogram definition %q", middle[0])
+			}
+			return newParseError(parseErrorBadLabel, "invalid labels %q", middle[0])
+		}
+	}
+
+	return newParseError(parseErrorMalformed, "invalid sample line")
+}
+
+func regexpSampleLabelsMapper(s string, out map[string]string) {
+	for _, labelWithValue := range regexpSplitSampleLine(s, sampleParserLabelsSeparator[0]) {
+		// expecting always 2 values. It's enforced by earlier regexp check
+		labelWithValueSlice := strings.SplitN(labelWithValue, sampleParserLabelFromValueSeparator, 2)
+		out[labelWithValueSlice[0]] = regexpUnescapeLabelValue(labelWithValueSlice[1])
+	}
+}
+
+// regexpSplitSampleLine splits s by sep, skipping separators placed inside quoted label value or quoted part.
+// Label value is quoted only when it starts right after the label name and the closing quote ends it.
+func regexpSplitSampleLine(s string, sep byte) []string {
+	var (
+		out        []string
+		start      int
+		inLabelKey = true
+	)
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case sampleParserQuote:
+			if i == start {
+				if end := regexpQuotedValueEnd(s, i); end > 0 {
+					i = end
+				}
+			}
+		case sampleParserLabelFromValueSeparator[0]:
+			if inLabelKey {
+				inLabelKey = false
+				if end := regexpQuotedValueEnd(s, i+1); end > 0 {
+					i = end
+				}
+			}
+		case sampleParserLabelsSeparator[0], sampleParserSamplePartsSeparator[0]:
+			inLabelKey = true
+			if c == sep {
+				out = append(out, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(out, s[start:])
+}
+
+// regexpQuotedValueEnd returns position of the quote closing value starting at i, or -1 when value is not quoted.
+// Value is quoted only if the closing quote is followed by separator or end of s.
+func regexpQuotedValueEnd(s string, i int) int {
+	if i >= len(s) || s[i] != sampleParserQuote {
+		return -1
+	}
+	for j := i + 1; j < len(s); j++ {
+		switch s[j] {
+		case sampleParserEscape:
+			j++
+		case sampleParserQuote:
+			if j+1 == len(s) || s[j+1] == sampleParserLabelsSeparator[0] || s[j+1] == sampleParserSamplePartsSeparator[0] {
+				return j
+			}
+			return -1
+		}
+	}
+	return -1
+}
+
+// regexpUnescapeLabelValue removes quotes around quoted label value and decodes its escape sequences:
+// \\ (backslash), \; (semicolon), \| (pipe), \" (quote) and \n (new line).
+// Backslash followed by any other character is left as is. Value which is not quoted is returned as is.
+func regexpUnescapeLabelValue(v string) string {
+	if len(v) < 2 || regexpQuotedValueEnd(v, 0) != len(v)-1 {
+		return v
+	}
+	v = v[1 : len(v)-1]
+	if strings.IndexByte(v, sampleParserEscape) < 0 {
+		return v
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		if v[i] == sampleParserEscape && i+1 < len(v) {
+			switch v[i+1] {
+			case sampleParserEscape, ';', '|', '"':
+				i++
+			case 'n':
+				i++
+				b.WriteByte('\n')
+				continue
+			}
+		}
+		b.WriteByte(v[i])
+	}
+	return b.String()
+}
+
+func regexpIsSampleLine(s string) bool {
+	return regexpSampleLineRE.MatchString(s)
+}
+
+func regexpIsHistogramDef(s string) bool {
+	return regexpHistogramDefRE.MatchString(s)
+}
+
+// regexpIsSampleValue checks if s is a valid sample value, i.e. any float accepted by strconv.ParseFloat.
+func regexpIsSampleValue(s string) bool {
+	_, err := strconv.ParseFloat(s, 64)
+	return err == nil
+}
+
+// regexpParseSampleLine converts valid sample line to sample.
+// Values not allowed for sample kind (negative counters, non-finite histogram observations) are reported with *parseError.
+func regexpParseSampleLine(s string, sharedLabels map[string]string) (*sample, *parseError) {
+	samplePartsSlice := regexpSplitSampleLine(s, sampleParserSamplePartsSeparator[0])
+
+	labels := make(map[string]string)
+	for k, v := range sharedLabels {
+		labels[k] = v
+	}
+
+	smp := sample{
+		name:   samplePartsSlice[0],
+		kind:   sampleKindMapper(samplePartsSlice[1]),
+		labels: labels,
+	}
+	value := samplePartsSlice[len(samplePartsSlice)-1]
+	var err error
+	if smp.value, err = strconv.ParseFloat(value, 64); err != nil {
+		return nil, newParseError(parseErrorBadValue, "invalid value %q", value)
+	}
+
+	switch smp.kind {
+	case sampleHistogramLinear, sampleHistogram:
+		// account for histogramDef
+		if len(samplePartsSlice) == 5 {
+			smp.histogramDef = strings.Split(samplePartsSlice[2], sampleParserHistogramDefSeparator)
+			regexpSampleLabelsMapper(samplePartsSlice[3], smp.labels)
+		} else if len(samplePartsSlice) == 4 {
+			if regexpIsHistogramDef(samplePartsSlice[2]) {
+				smp.histogramDef = strings.Split(samplePartsSlice[2], sampleParserHistogramDefSeparator)
+			} else {
+				regexpSampleLabelsMapper(samplePartsSlice[2], smp.labels)
+			}
+		}
+
+		if _, found := smp.labels[histogramBucketLabel]; found {
+			return nil, newParseError(parseErrorBadLabel, "label %q not allowed for histograms", histogramBucketLabel)
+		}
+		if math.IsNaN(smp.value) || math.IsInf(smp.value, 0) {
+			return nil, newParseError(parseErrorBadValue, "histogram observation must be finite, got %q", value)
+		}
+	default:
+		if len(samplePartsSlice) == 4 {
+			regexpSampleLabelsMapper(samplePartsSlice[2], smp.labels)
+		}
+	}
+
+	if smp.kind == sampleCounter && !(smp.value >= 0 && !math.IsInf(smp.value, 0)) {
+		return nil, newParseError(parseErrorBadValue, "counter value must be finite and not negative, got %q", value)
+	}
+
+	return &smp, nil
+}
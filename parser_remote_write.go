@@ -0,0 +1,258 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"math"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	// remoteWriteNameLabel is a label holding metric name of the series.
+	remoteWriteNameLabel = "__name__"
+
+	// Field numbers of remote write protobuf messages.
+	remoteWriteRequestSeriesField = 1
+	remoteWriteSeriesLabelField   = 1
+	remoteWriteSeriesSampleField  = 2
+	remoteWriteLabelNameField     = 1
+	remoteWriteLabelValueField    = 2
+	remoteWriteSampleValueField   = 1
+)
+
+// remoteWriteCounterSuffixes are suffixes of names of series assumed to be counters,
+// when no kind rule matches.
+var remoteWriteCounterSuffixes = []string{"_total", "_count", "_sum", "_bucket"}
+
+// remoteWriteFormat converts Prometheus remote write requests (snappy compressed WriteRequest protobuf) to samples.
+//
+// Each series is mapped to counter or gauge picked by rules or, when none matches, by name suffix.
+// Values of counters are cumulative, so they are converted to increases since the previous write
+// of the series by the same sender. Gauges are set. Native histograms, exemplars, metadata and timestamps are ignored.
+// Invalid series are skipped and reported with batchErrors.
+type remoteWriteFormat struct {
+	rules      kindRules
+	cumulative *cumulativeTracker
+
+	// maxDecodedSize limits size of the decompressed request in bytes.
+	maxDecodedSize int
+}
+
+// remoteWriteSeries is a single series of the write request.
+type remoteWriteSeries struct {
+	labels map[string]string
+	values []float64
+}
+
+// newRemoteWriteFormat creates Prometheus remote write format.
+func newRemoteWriteFormat(rules kindRules, cumulative *cumulativeTracker, maxDecodedSize int) *sampleFormat {
+	f := &remoteWriteFormat{
+		rules:          rules,
+		cumulative:     cumulative,
+		maxDecodedSize: maxDecodedSize,
+	}
+	return &sampleFormat{
+		name: "remote_write",
+		parse: func(r io.Reader) ([]*sample, error) {
+			return f.parse(r, "")
+		},
+		parseFrom: f.parse,
+	}
+}
+
+// parse converts whole write request pushed by sender to samples.
+func (f *remoteWriteFormat) parse(r io.Reader, sender string) ([]*sample, error) {
+	compressed, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := snappy.DecodedLen(compressed)
+	if err != nil {
+		return nil, errors.Wrap(err, "decompressing remote write request")
+	}
+	if size > f.maxDecodedSize {
+		return nil, errors.Errorf("decompressed remote write request exceeds %d bytes", f.maxDecodedSize)
+	}
+	body, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, errors.Wrap(err, "decompressing remote write request")
+	}
+
+	var (
+		out     []*sample
+		invalid batchErrors
+		index   int
+	)
+	err = decodeProtoFields(body, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		if num != remoteWriteRequestSeriesField || typ != protowire.BytesType {
+			return nil
+		}
+
+		series, err := decodeRemoteWriteSeries(value)
+		if err != nil {
+			return err
+		}
+		var invalidSeries *parseError
+		if out, invalidSeries = f.appendSeries(out, series, sender); invalidSeries != nil {
+			invalidSeries.Index = index
+			invalid = append(invalid, invalidSeries)
+		}
+		index++
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding remote write request")
+	}
+
+	if len(invalid) > 0 {
+		return out, invalid
+	}
+	return out, nil
+}
+
+// appendSeries converts values of the series pushed by sender to samples and appends them to out.
+func (f *remoteWriteFormat) appendSeries(out []*sample, series *remoteWriteSeries, sender string) ([]*sample, *parseError) {
+	name := series.labels[remoteWriteNameLabel]
+	if !metricNameRE.MatchString(name) {
+		return out, newParseError(parseErrorBadName, "invalid metric name %q", name)
+	}
+
+	labels := make(map[string]string, len(series.labels)-1)
+	for k, v := range series.labels {
+		if k == remoteWriteNameLabel {
+			continue
+		}
+		if err := validateLabelName(k); err != nil {
+			return out, err
+		}
+		if !utf8.ValidString(v) {
+			// such value can not be exposed, it would break every following scrape
+			return out, newParseError(parseErrorBadLabel, "invalid UTF-8 in value of label %q", k)
+		}
+		labels[k] = v
+	}
+
+	kind := f.rules.kind(name, sampleUnknown)
+	if kind == sampleUnknown {
+		kind = sampleGauge
+		for _, suffix := range remoteWriteCounterSuffixes {
+			if strings.HasSuffix(name, suffix) {
+				kind = sampleCounter
+				break
+			}
+		}
+	}
+
+	for _, v := range series.values {
+		if math.IsNaN(v) {
+			// staleness marker or missing value
+			continue
+		}
+
+		s := &sample{
+			name:   name,
+			kind:   kind,
+			labels: labels,
+			value:  v,
+		}
+		if kind == sampleCounter {
+			if v < 0 || math.IsInf(v, 0) {
+				continue
+			}
+			s.value = f.cumulative.counterDelta(cumulativeKey(s.hash(), sender), 0, v)
+		}
+		out = append(out, s)
+	}
+
+	return out, nil
+}
+
+// decodeRemoteWriteSeries decodes TimeSeries message.
+func decodeRemoteWriteSeries(b []byte) (*remoteWriteSeries, error) {
+	series := &remoteWriteSeries{labels: make(map[string]string)}
+
+	err := decodeProtoFields(b, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+
+		switch num {
+		case remoteWriteSeriesLabelField:
+			var name, labelValue string
+			err := decodeProtoFields(value, func(num protowire.Number, typ protowire.Type, value []byte) error {
+				if typ != protowire.BytesType {
+					return nil
+				}
+				switch num {
+				case remoteWriteLabelNameField:
+					name = string(value)
+				case remoteWriteLabelValueField:
+					labelValue = string(value)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			series.labels[name] = labelValue
+
+		case remoteWriteSeriesSampleField:
+			var sampleValue float64
+			err := decodeProtoFields(value, func(num protowire.Number, typ protowire.Type, value []byte) error {
+				if num == remoteWriteSampleValueField && typ == protowire.Fixed64Type {
+					v, _ := protowire.ConsumeFixed64(value)
+					sampleValue = math.Float64frombits(v)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			series.values = append(series.values, sampleValue)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return series, nil
+}
+
+// decodeProtoFields calls fn for each field of protobuf message encoded in b.
+// For length delimited fields value holds the content, for other fields it holds the encoded value.
+func decodeProtoFields(b []byte, fn func(num protowire.Number, typ protowire.Type, value []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		var value []byte
+		if typ == protowire.BytesType {
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			value, b = v, b[n:]
+		} else {
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			value, b = b[:n], b[n:]
+		}
+
+		if err := fn(num, typ, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
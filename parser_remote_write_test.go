@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	a "github.com/stretchr/testify/assert"
+)
+
+// thRemoteWriteSeries is a series encoded by thRemoteWriteRequest.
+type thRemoteWriteSeries struct {
+	labels []string // name, value pairs
+	values []float64
+}
+
+// thRemoteWriteRequest encodes snappy compressed WriteRequest.
+func thRemoteWriteRequest(series ...thRemoteWriteSeries) []byte {
+	var req []byte
+	for _, s := range series {
+		var ts []byte
+		for i := 0; i < len(s.labels); i += 2 {
+			var l []byte
+			l = protowire.AppendTag(l, remoteWriteLabelNameField, protowire.BytesType)
+			l = protowire.AppendString(l, s.labels[i])
+			l = protowire.AppendTag(l, remoteWriteLabelValueField, protowire.BytesType)
+			l = protowire.AppendString(l, s.labels[i+1])
+			ts = protowire.AppendTag(ts, remoteWriteSeriesLabelField, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, l)
+		}
+		for i, v := range s.values {
+			var smp []byte
+			smp = protowire.AppendTag(smp, remoteWriteSampleValueField, protowire.Fixed64Type)
+			smp = protowire.AppendFixed64(smp, math.Float64bits(v))
+			smp = protowire.AppendTag(smp, 2, protowire.VarintType)
+			smp = protowire.AppendVarint(smp, uint64(1690000000000+i))
+			ts = protowire.AppendTag(ts, remoteWriteSeriesSampleField, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, smp)
+		}
+		req = protowire.AppendTag(req, remoteWriteRequestSeriesField, protowire.BytesType)
+		req = protowire.AppendBytes(req, ts)
+	}
+	return snappy.Encode(nil, req)
+}
+
+func Test_RemoteWriteParser_Parse_Success(t *testing.T) {
+	defer thInitSampleHasher(hashMD5)()
+
+	rules, err := parseKindRules([]string{"g:^process_.*_total$", "c:_events$"})
+	if !a.NoError(t, err) {
+		return
+	}
+	format := newRemoteWriteFormat(rules, newCumulativeTracker(time.Hour), 1024)
+
+	body := thRemoteWriteRequest(
+		thRemoteWriteSeries{[]string{"__name__", "http_requests_total", "code", "200"}, []float64{5, 8, math.Float64frombits(0x7ff0000000000002)}},
+		thRemoteWriteSeries{[]string{"__name__", "queue_length"}, []float64{3}},
+		thRemoteWriteSeries{[]string{"__name__", "process_cpu_seconds_total"}, []float64{1.5}},
+		thRemoteWriteSeries{[]string{"__name__", "jobs_events"}, []float64{2}},
+		thRemoteWriteSeries{[]string{"__name__", "request_duration_seconds_bucket", "le", "0.5"}, []float64{7}},
+	)
+
+	exp := []sample{
+		{name: "http_requests_total", kind: sampleCounter, labels: map[string]string{"code": "200"}, value: 5},
+		{name: "http_requests_total", kind: sampleCounter, labels: map[string]string{"code": "200"}, value: 3},
+		{name: "queue_length", kind: sampleGauge, labels: map[string]string{}, value: 3},
+		{name: "process_cpu_seconds_total", kind: sampleGauge, labels: map[string]string{}, value: 1.5},
+		{name: "jobs_events", kind: sampleCounter, labels: map[string]string{}, value: 2},
+		{name: "request_duration_seconds_bucket", kind: sampleCounter, labels: map[string]string{"le": "0.5"}, value: 7},
+	}
+
+	got, err := format.parse(bytes.NewReader(body))
+	if !a.NoError(t, err) {
+		return
+	}
+	if a.Len(t, got, len(exp)) {
+		for i := range exp {
+			a.Equal(t, exp[i], *got[i])
+		}
+	}
+
+	// cumulative counters are converted to increases between requests
+	got, err = format.parse(bytes.NewReader(thRemoteWriteRequest(
+		thRemoteWriteSeries{[]string{"__name__", "http_requests_total", "code", "200"}, []float64{10}},
+	)))
+	if a.NoError(t, err) && a.Len(t, got, 1) {
+		a.Equal(t, 2.0, got[0].value)
+	}
+}
+
+func Test_RemoteWriteParser_Parse_InvalidSeries(t *testing.T) {
+	defer thInitSampleHasher(hashMD5)()
+
+	format := newRemoteWriteFormat(nil, newCumulativeTracker(time.Hour), 1024)
+	body := thRemoteWriteRequest(
+		thRemoteWriteSeries{[]string{"code", "200"}, []float64{1}},
+		thRemoteWriteSeries{[]string{"__name__", "queue_length"}, []float64{3}},
+		thRemoteWriteSeries{[]string{"__name__", "queue_length", "__meta", "x"}, []float64{3}},
+		thRemoteWriteSeries{[]string{"__name__", "queue_length", "host", "a\xffb"}, []float64{3}},
+		thRemoteWriteSeries{[]string{"__name__", "queue_\xc3", "host", "a"}, []float64{3}},
+		thRemoteWriteSeries{[]string{"__name__", "queue_length", "ho\xffst", "a"}, []float64{3}},
+	)
+
+	got, err := format.parse(bytes.NewReader(body))
+	a.Len(t, got, 1)
+	invalid, ok := err.(batchErrors)
+	if a.True(t, ok, "batchErrors expected, got: %v", err) && a.Len(t, invalid, 5) {
+		a.Equal(t, 0, invalid[0].Index)
+		a.Equal(t, 2, invalid[1].Index)
+		a.Equal(t, 3, invalid[2].Index)
+		a.Equal(t, parseErrorBadLabel, invalid[2].Reason)
+		a.Equal(t, 4, invalid[3].Index)
+		a.Equal(t, parseErrorBadName, invalid[3].Reason)
+		a.Equal(t, 5, invalid[4].Index)
+		a.Equal(t, parseErrorBadLabel, invalid[4].Reason)
+	}
+}
+
+func Test_RemoteWriteParser_Parse_Malformed(t *testing.T) {
+	format := newRemoteWriteFormat(nil, newCumulativeTracker(time.Hour), 16)
+
+	cases := map[string][]byte{
+		"not snappy":      []byte("not snappy"),
+		"not protobuf":    snappy.Encode(nil, []byte{0x0a, 0xff}),
+		"decoded too big": snappy.Encode(nil, make([]byte, 17)),
+	}
+
+	for k, body := range cases {
+		_, err := format.parse(bytes.NewReader(body))
+		a.Error(t, err, k)
+	}
+}
+
+func Test_Server_RemoteWriteHandler(t *testing.T) {
+	defer thInitSampleHasher(hashMD5)()
+	defer thInitRegistry()()
+
+	s := newServer(func(smp *sample) error {
+		if smp.kind == sampleGauge {
+			return ErrIngressQueueFull
+		}
+		return nil
+	}, 1024)
+
+	body := thRemoteWriteRequest(
+		thRemoteWriteSeries{[]string{"__name__", "http_requests_total"}, []float64{5}},
+		thRemoteWriteSeries{[]string{"__name__", "queue_length"}, []float64{3}},
+	)
+	w := httptest.NewRecorder()
+	s.remoteWriteHandler(1024, newRemoteWriteFormat(nil, newCumulativeTracker(time.Hour), 1024))(w, httptest.NewRequest(http.MethodPost, "/api/v1/write", bytes.NewReader(body)))
+
+	a.Equal(t, http.StatusOK, w.Code)
+	a.Equal(t, "1", w.Header().Get(remoteWriteSamplesWrittenHeader))
+	a.Equal(t, `{"accepted":1,"rejected":1}`+"\n", w.Body.String())
+}
+
+func Test_Server_RemoteWriteHandler_InterleavedSenders(t *testing.T) {
+	defer thInitSampleHasher(hashMD5)()
+	defer thInitRegistry()()
+
+	var got []float64
+	s := newServer(func(smp *sample) error {
+		got = append(got, smp.value)
+		return nil
+	}, 1024)
+	handler := s.remoteWriteHandler(1024, newRemoteWriteFormat(nil, newCumulativeTracker(time.Hour), 1024))
+
+	writes := []struct {
+		remoteAddr string
+		value      float64
+	}{
+		{"10.0.0.1:40001", 100},
+		{"10.0.0.2:40001", 10},
+		{"10.0.0.1:40002", 105},
+		{"10.0.0.2:40003", 12},
+		{"10.0.0.1:40002", 101},
+	}
+	for _, write := range writes {
+		body := thRemoteWriteRequest(thRemoteWriteSeries{[]string{"__name__", "http_requests_total"}, []float64{write.value}})
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/write", bytes.NewReader(body))
+		req.RemoteAddr = write.remoteAddr
+		w := httptest.NewRecorder()
+		handler(w, req)
+		a.Equal(t, http.StatusOK, w.Code)
+	}
+
+	// each sender is tracked separately, regardless of its port
+	a.Equal(t, []float64{100, 10, 5, 2, 101}, got)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	statsDNameFromValueSeparator = ":"
+	statsDPartsSeparator         = "|"
+	statsDSampleRatePrefix       = "@"
+
+	statsDCounter   = "c"
+	statsDGauge     = "g"
+	statsDTimer     = "ms"
+	statsDHistogram = "h"
+	statsDDistrib   = "d"
+	statsDSet       = "s"
+)
+
+// statsDLineParser converts lines in StatsD format to samples.
+//
+// Line format is:
+//
+//	name:value|type[|@sampleRate]
+//
+// Counters (c) are mapped to counters, with sample rate applied by collector.
+// Gauges (g) are mapped to gauges. Value with explicit sign (+ or -) changes the gauge instead of setting it.
+// Timers (ms) are mapped to histograms with default buckets and values converted to seconds.
+// Histograms (h) and distributions (d) are mapped to histograms with default buckets.
+// Sets (s) are mapped to sets, value is a token of which distinct ones are counted.
+// Characters not allowed in Prometheus metric names are replaced with underscore.
+type statsDLineParser struct{}
+
+// parseLine implements lineParser.
+func (p statsDLineParser) parseLine(line string, out []*sample) ([]*sample, error) {
+	if s := parseStatsDLine(line); s != nil {
+		return append(out, s), nil
+	}
+	return out, nil
+}
+
+// parseStatsDLine parses single StatsD line. It returns nil for invalid lines.
+func parseStatsDLine(line string) *sample {
+	s, parts := parseStatsDMetric(line)
+	if s == nil {
+		return nil
+	}
+
+	for _, part := range parts {
+		if !strings.HasPrefix(part, statsDSampleRatePrefix) || s.sampleRate != 0 {
+			return nil
+		}
+		rate, err := strconv.ParseFloat(part[len(statsDSampleRatePrefix):], 64)
+		if err != nil || !isValidSampleRate(rate) {
+			return nil
+		}
+		s.sampleRate = rate
+	}
+
+	return s
+}
+
+// parseStatsDMetric parses name, value and type of StatsD line.
+// Returns parsed sample and remaining, unparsed parts of the line.
+func parseStatsDMetric(line string) (*sample, []string) {
+	nameEnd := strings.Index(line, statsDNameFromValueSeparator)
+	if nameEnd < 1 {
+		return nil, nil
+	}
+
+	parts := strings.Split(line[nameEnd+1:], statsDPartsSeparator)
+	if len(parts) < 2 {
+		return nil, nil
+	}
+
+	s := &sample{
+		name:   sanitizeMetricName(line[:nameEnd]),
+		labels: make(map[string]string),
+	}
+
+	valueStr := parts[0]
+	if parts[1] == statsDSet {
+		if valueStr == "" {
+			return nil, nil
+		}
+		s.kind = sampleSet
+		s.token = valueStr
+		return s, parts[2:]
+	}
+
+	value, err := strconv.ParseFloat(valueStr, 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil, nil
+	}
+
+	switch parts[1] {
+	case statsDCounter:
+		if value < 0 {
+			return nil, nil
+		}
+		s.kind = sampleCounter
+		s.value = value
+
+	case statsDGauge:
+		s.kind = sampleGauge
+		s.value = value
+		switch valueStr[0] {
+		case '+':
+			s.gaugeOp = gaugeOpAdd
+		case '-':
+			s.gaugeOp = gaugeOpSub
+			s.value = -value
+		}
+
+	case statsDTimer:
+		s.kind = sampleHistogram
+		s.value = value / 1000
+
+	case statsDHistogram, statsDDistrib:
+		s.kind = sampleHistogram
+		s.value = value
+
+	default:
+		return nil, nil
+	}
+
+	return s, parts[2:]
+}
+
+// sanitizeMetricName replaces characters not allowed in Prometheus metric name with underscore.
+// Name starting with digit is prefixed with underscore.
+func sanitizeMetricName(name string) string {
+	out := []byte(name)
+	for i, c := range out {
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' || c == ':' {
+			continue
+		}
+		out[i] = '_'
+	}
+	if len(out) > 0 && out[0] >= '0' && out[0] <= '9' {
+		return "_" + string(out)
+	}
+	return string(out)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	a "github.com/stretchr/testify/assert"
+)
+
+func Test_StatsDParser_Parse_Success(t *testing.T) {
+	cases := map[string]struct {
+		in  string
+		exp []sample
+	}{
+		"counter": {
+			`requests.total:12|c`,
+			[]sample{
+				{name: "requests_total", kind: sampleCounter, labels: map[string]string{}, value: 12},
+			},
+		},
+		"counter with sample rate": {
+			`requests:3|c|@0.1`,
+			[]sample{
+				{name: "requests", kind: sampleCounter, labels: map[string]string{}, value: 3, sampleRate: 0.1},
+			},
+		},
+		"gauges": {
+			`queue.size:17.3|g
+queue.size:+2|g
+queue.size:-4.5|g`,
+			[]sample{
+				{name: "queue_size", kind: sampleGauge, labels: map[string]string{}, value: 17.3},
+				{name: "queue_size", kind: sampleGauge, labels: map[string]string{}, value: 2, gaugeOp: gaugeOpAdd},
+				{name: "queue_size", kind: sampleGauge, labels: map[string]string{}, value: 4.5, gaugeOp: gaugeOpSub},
+			},
+		},
+		"timer in seconds": {
+			`request-duration:320|ms|@0.5`,
+			[]sample{
+				{name: "request_duration", kind: sampleHistogram, labels: map[string]string{}, value: 0.32, sampleRate: 0.5},
+			},
+		},
+		"histogram and distribution": {
+			`size:320|h
+2xx.size:3|d`,
+			[]sample{
+				{name: "size", kind: sampleHistogram, labels: map[string]string{}, value: 320},
+				{name: "_2xx_size", kind: sampleHistogram, labels: map[string]string{}, value: 3},
+			},
+		},
+		"sets": {
+			`users:john|s
+users:42|s|@0.5`,
+			[]sample{
+				{name: "users", kind: sampleSet, labels: map[string]string{}, token: "john"},
+				{name: "users", kind: sampleSet, labels: map[string]string{}, token: "42", sampleRate: 0.5},
+			},
+		},
+		"invalid lines skipped": {
+			`users:|s
+:1|c
+requests:1
+requests:-1|c
+requests:1|c|@0
+requests:1|c|@1.5
+requests:1|ms|@0.0009
+requests:1|c|@1e-300
+requests:1|c|@0.5|@0.5
+requests:1|c|#tag:value
+requests:abc|c
+requests:2|x
+requests:1|c`,
+			[]sample{
+				{name: "requests", kind: sampleCounter, labels: map[string]string{}, value: 1},
+			},
+		},
+	}
+
+	for k, tc := range cases {
+		got, err := formatStatsD.parse(strings.NewReader(tc.in))
+		if !a.NoError(t, err, k) {
+			continue
+		}
+
+		if !a.Len(t, got, len(tc.exp), k) {
+			continue
+		}
+		for i := range tc.exp {
+			a.Equal(t, tc.exp[i], *got[i], k)
+		}
+	}
+}
+
+func Test_SanitizeMetricName(t *testing.T) {
+	cases := map[string]string{
+		"requests_total":     "requests_total",
+		"api.requests-total": "api_requests_total",
+		"app:requests":       "app:requests",
+		"5xx.responses":      "_5xx_responses",
+		"requests/sec (avg)": "requests_sec__avg_",
+	}
+
+	for in, exp := range cases {
+		a.Equal(t, exp, sanitizeMetricName(in), in)
+	}
+}
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
+	"math"
+	"regexp"
 	"strings"
 	"testing"
+	"time"
 
 	a "github.com/stretchr/testify/assert"
 )
@@ -63,6 +68,54 @@ name_of_3_metric|g|17.3`,
 				},
 			},
 		},
+		"gauge changes": {
+			`service=srvA1
+name_of_1_metric|g+|1
+name_of_1_metric|g-|labelA=labelValueA|2.5
+name_of_1_metric|g|-3`,
+			[]sample{
+				{
+					name: "name_of_1_metric", kind: sampleGauge,
+					labels:  map[string]string{"service": "srvA1"},
+					value:   1,
+					gaugeOp: gaugeOpAdd,
+				},
+				{
+					name: "name_of_1_metric", kind: sampleGauge,
+					labels:  map[string]string{"service": "srvA1", "labelA": "labelValueA"},
+					value:   2.5,
+					gaugeOp: gaugeOpSub,
+				},
+				{
+					name: "name_of_1_metric", kind: sampleGauge,
+					labels: map[string]string{"service": "srvA1"},
+					value:  -3,
+				},
+			},
+		},
+		"sets": {
+			`users|u|john
+users|u|path=/a|"|x|"
+users|u|"@alice"|@0.5`,
+			[]sample{
+				{
+					name: "users", kind: sampleSet,
+					labels: map[string]string{},
+					token:  "john",
+				},
+				{
+					name: "users", kind: sampleSet,
+					labels: map[string]string{"path": "/a"},
+					token:  "|x|",
+				},
+				{
+					name: "users", kind: sampleSet,
+					labels:     map[string]string{},
+					token:      "@alice",
+					sampleRate: 0.5,
+				},
+			},
+		},
 		"histogram, linear buckets": {
 			`name_of_1_metric_seconds|hl|3.3;2.0;5|labelA=labelValueA;label2=labelValue2|12.345`,
 			[]sample{
@@ -74,6 +127,47 @@ name_of_3_metric|g|17.3`,
 				},
 			},
 		},
+		"histogram, exponential buckets": {
+			`name_of_1_metric_seconds|he|0.001;2;16|labelA=labelValueA|0.3
+name_of_2_metric_seconds|he|0.5;1.5;4|1`,
+			[]sample{
+				{
+					name: "name_of_1_metric_seconds", kind: sampleHistogramExponential,
+					labels:       map[string]string{"labelA": "labelValueA"},
+					value:        0.3,
+					histogramDef: []string{"0.001", "2", "16"},
+				},
+				{
+					name: "name_of_2_metric_seconds", kind: sampleHistogramExponential,
+					labels:       map[string]string{},
+					value:        1,
+					histogramDef: []string{"0.5", "1.5", "4"},
+				},
+			},
+		},
+		"native histogram": {
+			`name_of_1_metric_seconds|hn|1.05|labelA=labelValueA|0.3
+name_of_2_metric_seconds|hn|labelA=labelValueA|0.3
+name_of_3_metric_seconds|hn|-1`,
+			[]sample{
+				{
+					name: "name_of_1_metric_seconds", kind: sampleHistogramNative,
+					labels:       map[string]string{"labelA": "labelValueA"},
+					value:        0.3,
+					histogramDef: []string{"1.05"},
+				},
+				{
+					name: "name_of_2_metric_seconds", kind: sampleHistogramNative,
+					labels: map[string]string{"labelA": "labelValueA"},
+					value:  0.3,
+				},
+				{
+					name: "name_of_3_metric_seconds", kind: sampleHistogramNative,
+					labels: map[string]string{},
+					value:  -1,
+				},
+			},
+		},
 		"histogram": {
 			`name_of_2_metric_seconds|h|2.0;2.2;5;7|labelA=labelValueA;label2=labelValue2|12.345`,
 			[]sample{
@@ -85,6 +179,189 @@ name_of_3_metric|g|17.3`,
 				},
 			},
 		},
+		"timestamps": {
+			`name_of_1_metric|g|7.3|T1700000000
+name_of_2_metric_total|c|labelA=labelValueA|1|T1700000000.5|@0.5
+name_of_3_metric_seconds|h|0.5;1|0.7|@0.5|T1700000000
+users|u|labelA=labelValueA|Tom
+users|u|labelA=labelValueA|T1900000000
+users|u|labelA=labelValueA|@alice|T1700000000
+users|u|john|T1700000000
+users|u|"a=b"|T1700000000`,
+			[]sample{
+				{
+					name: "name_of_1_metric", kind: sampleGauge,
+					labels:    map[string]string{},
+					value:     7.3,
+					timestamp: time.Unix(1700000000, 0),
+				},
+				{
+					name: "name_of_2_metric_total", kind: sampleCounter,
+					labels:     map[string]string{"labelA": "labelValueA"},
+					value:      1,
+					sampleRate: 0.5,
+					timestamp:  time.Unix(1700000000, 5e8),
+				},
+				{
+					name: "name_of_3_metric_seconds", kind: sampleHistogram,
+					labels:       map[string]string{},
+					value:        0.7,
+					histogramDef: []string{"0.5", "1"},
+					sampleRate:   0.5,
+					timestamp:    time.Unix(1700000000, 0),
+				},
+				{
+					name: "users", kind: sampleSet,
+					labels: map[string]string{"labelA": "labelValueA"},
+					token:  "Tom",
+				},
+				{
+					// token following labels is not a timestamp
+					name: "users", kind: sampleSet,
+					labels: map[string]string{"labelA": "labelValueA"},
+					token:  "T1900000000",
+				},
+				{
+					name: "users", kind: sampleSet,
+					labels:    map[string]string{"labelA": "labelValueA"},
+					token:     "@alice",
+					timestamp: time.Unix(1700000000, 0),
+				},
+				{
+					name: "users", kind: sampleSet,
+					labels:    map[string]string{},
+					token:     "john",
+					timestamp: time.Unix(1700000000, 0),
+				},
+				{
+					// quoted, as it would be taken for labels
+					name: "users", kind: sampleSet,
+					labels:    map[string]string{},
+					token:     "a=b",
+					timestamp: time.Unix(1700000000, 0),
+				},
+			},
+		},
+		"metadata": {
+			`#HELP name_of_1_metric_seconds Duration of requests; in seconds.
+service=srvA1
+# UNIT name_of_1_metric_seconds seconds
+name_of_1_metric_seconds|h|0.5`,
+			[]sample{
+				{
+					name: "name_of_1_metric_seconds", kind: sampleMetadata,
+					labels: map[string]string{},
+					meta:   metricMetadata{Help: "Duration of requests; in seconds."},
+				},
+				{
+					name: "name_of_1_metric_seconds", kind: sampleMetadata,
+					labels: map[string]string{},
+					meta:   metricMetadata{Unit: "seconds"},
+				},
+				{
+					name: "name_of_1_metric_seconds", kind: sampleHistogram,
+					labels: map[string]string{"service": "srvA1"},
+					value:  0.5,
+				},
+			},
+		},
+		"negative and scientific notation values": {
+			`name_of_1_metric|g|-7.3
+name_of_2_metric|g|labelA=labelValueA|1.5e-7
+name_of_3_metric_total|c|2E+3
+name_of_4_metric_seconds|h|0.5;1|-0.5
+name_of_5_metric|g|+Inf`,
+			[]sample{
+				{
+					name: "name_of_1_metric", kind: sampleGauge,
+					labels: map[string]string{},
+					value:  -7.3,
+				},
+				{
+					name: "name_of_2_metric", kind: sampleGauge,
+					labels: map[string]string{"labelA": "labelValueA"},
+					value:  1.5e-7,
+				},
+				{
+					name: "name_of_3_metric_total", kind: sampleCounter,
+					labels: map[string]string{},
+					value:  2000,
+				},
+				{
+					name: "name_of_4_metric_seconds", kind: sampleHistogram,
+					labels:       map[string]string{},
+					value:        -0.5,
+					histogramDef: []string{"0.5", "1"},
+				},
+				{
+					name: "name_of_5_metric", kind: sampleGauge,
+					labels: map[string]string{},
+					value:  math.Inf(1),
+				},
+			},
+		},
+		"summary": {
+			`name_of_1_metric_seconds|s|0.5:0.05;0.99:0.001;5m|labelA=labelValueA|0.3
+name_of_1_metric_seconds|s|1m|0.3
+name_of_1_metric_seconds|s|labelA=labelValueA|0.3|@0.5`,
+			[]sample{
+				{
+					name: "name_of_1_metric_seconds", kind: sampleSummary,
+					labels:     map[string]string{"labelA": "labelValueA"},
+					value:      0.3,
+					summaryDef: []string{"0.5:0.05", "0.99:0.001", "5m"},
+				},
+				{
+					name: "name_of_1_metric_seconds", kind: sampleSummary,
+					labels:     map[string]string{},
+					value:      0.3,
+					summaryDef: []string{"1m"},
+				},
+				{
+					name: "name_of_1_metric_seconds", kind: sampleSummary,
+					labels: map[string]string{"labelA": "labelValueA"},
+					value:  0.3, sampleRate: 0.5,
+				},
+			},
+		},
+		"sample rate": {
+			`name_of_1_metric_total|c|1|@0.1
+name_of_2_metric_total|c|labelA=labelValueA|2|@0.5
+name_of_3_metric_seconds|h|0.5;1|labelA=labelValueA|0.3|@0.25
+name_of_4_metric_seconds|hl|1;1;3|0.3|@1
+name_of_5_metric|g|3|@0.5`,
+			[]sample{
+				{
+					name: "name_of_1_metric_total", kind: sampleCounter,
+					labels: map[string]string{},
+					value:  1, sampleRate: 0.1,
+				},
+				{
+					name: "name_of_2_metric_total", kind: sampleCounter,
+					labels: map[string]string{"labelA": "labelValueA"},
+					value:  2, sampleRate: 0.5,
+				},
+				{
+					name: "name_of_3_metric_seconds", kind: sampleHistogram,
+					labels:       map[string]string{"labelA": "labelValueA"},
+					value:        0.3,
+					histogramDef: []string{"0.5", "1"},
+					sampleRate:   0.25,
+				},
+				{
+					name: "name_of_4_metric_seconds", kind: sampleHistogramLinear,
+					labels:       map[string]string{},
+					value:        0.3,
+					histogramDef: []string{"1", "1", "3"},
+					sampleRate:   1,
+				},
+				{
+					name: "name_of_5_metric", kind: sampleGauge,
+					labels: map[string]string{},
+					value:  3, sampleRate: 0.5,
+				},
+			},
+		},
 	}
 
 	for k, tc := range cases {
@@ -104,3 +381,349 @@ name_of_3_metric|g|17.3`,
 		}
 	}
 }
+
+func Test_SampleParser_Parse_Errors(t *testing.T) {
+	cases := map[string]struct {
+		in        string
+		expReason parseErrorReason
+	}{
+		"bad name":                       {"1name|c|1", parseErrorBadName},
+		"bad kind":                       {"name_of_1_metric_total|x|1", parseErrorBadKind},
+		"bad value":                      {"name_of_1_metric_total|c|abc", parseErrorBadValue},
+		"bad label":                      {"name_of_1_metric_total|c|label-A=x|1", parseErrorBadLabel},
+		"bad label in histogram":         {"name_of_1_metric_seconds|h|1;2|label-A=x|1", parseErrorBadLabel},
+		"bucket label in histogram":      {"name_of_1_metric_seconds|h|1;2|le=x|1", parseErrorBadLabel},
+		"bad histogram def":              {"name_of_1_metric_seconds|h|1;a|1", parseErrorBadHistogramDef},
+		"histogram not increasing":       {"name_of_1_metric_seconds|h|5;1|1", parseErrorBadHistogramDef},
+		"histogram equal buckets":        {"name_of_1_metric_seconds|h|1;1|labelA=x|1", parseErrorBadHistogramDef},
+		"histogram bad bucket":           {"name_of_1_metric_seconds|h|1.2.3|1", parseErrorBadHistogramDef},
+		"linear histogram no def":        {"name_of_1_metric_seconds|hl|labelA=x|1", parseErrorBadHistogramDef},
+		"linear histogram no parts":      {"name_of_1_metric_seconds|hl|1", parseErrorBadHistogramDef},
+		"linear histogram 1 part":        {"name_of_1_metric_seconds|hl|5|1", parseErrorBadHistogramDef},
+		"linear histogram zero width":    {"name_of_1_metric_seconds|hl|1;0;3|1", parseErrorBadHistogramDef},
+		"linear histogram zero count":    {"name_of_1_metric_seconds|hl|1;2;0|labelA=x|1", parseErrorBadHistogramDef},
+		"linear histogram count":         {"name_of_1_metric_seconds|hl|1;2;1.5|1", parseErrorBadHistogramDef},
+		"linear histogram too many":      {"name_of_1_metric_seconds|hl|1;2;1001|1", parseErrorBadHistogramDef},
+		"linear histogram precision":     {"name_of_1_metric_seconds|hl|100000000000000000000;1;3|1", parseErrorBadHistogramDef},
+		"bad histogram def with labels":  {"name_of_1_metric_seconds|hl|1;a;3|labelA=x|1", parseErrorBadHistogramDef},
+		"exponential histogram no def":   {"name_of_1_metric_seconds|he|labelA=x|1", parseErrorBadHistogramDef},
+		"exponential histogram zero":     {"name_of_1_metric_seconds|he|0;2;10|1", parseErrorBadHistogramDef},
+		"exponential histogram factor 1": {"name_of_1_metric_seconds|he|1;1;10|labelA=x|1", parseErrorBadHistogramDef},
+		"exponential histogram count":    {"name_of_1_metric_seconds|he|1;2;1.5|1", parseErrorBadHistogramDef},
+		"exponential histogram too many": {"name_of_1_metric_seconds|he|1;2;1001|1", parseErrorBadHistogramDef},
+		"exponential histogram overflow": {"name_of_1_metric_seconds|he|1;10;400|1", parseErrorBadHistogramDef},
+		"exponential histogram 2 parts":  {"name_of_1_metric_seconds|he|1;2|1", parseErrorBadHistogramDef},
+		"bucket label in exp. histogram": {"name_of_1_metric_seconds|he|1;2;3|le=x|1", parseErrorBadLabel},
+		"native histogram factor 1":      {"name_of_1_metric_seconds|hn|1|1", parseErrorBadHistogramDef},
+		"native histogram 2 factors":     {"name_of_1_metric_seconds|hn|1.1;1.2|labelA=x|1", parseErrorBadHistogramDef},
+		"NaN native histogram value":     {"name_of_1_metric_seconds|hn|NaN", parseErrorBadValue},
+		"NaN gauge change":               {"name_of_1_metric|g+|NaN", parseErrorBadValue},
+		"infinite gauge change":          {"name_of_1_metric|g-|labelA=x|+Inf", parseErrorBadValue},
+		"unknown gauge change":           {"name_of_1_metric|g*|1", parseErrorBadKind},
+		"histogram def in gauge change":  {"name_of_1_metric|g+|1;2|1", parseErrorBadLabel},
+		"empty set token":                {"users|u|labelA=x|", parseErrorBadValue},
+		"zero timestamp":                 {"name_of_1_metric_total|c|1|T0", parseErrorBadTimestamp},
+		"timestamp out of range":         {"name_of_1_metric_total|c|1|@0.5|T99999999999", parseErrorBadTimestamp},
+		"malformed timestamp":            {"name_of_1_metric_total|c|labelA=x|1|T1.2.3", parseErrorBadTimestamp},
+		"timestamp twice":                {"name_of_1_metric_total|c|1|T1700000000|T1700000000", parseErrorBadValue},
+		"too many parts with timestamp":  {"name_of_1_metric_seconds|h|1;2|labelA=x|labelB=y|1|@0.5|T1700000000", parseErrorMalformed},
+		"unknown metadata":               {"#TYPE name_of_1_metric_seconds histogram", parseErrorMalformed},
+		"empty help":                     {"#HELP name_of_1_metric_seconds", parseErrorMalformed},
+		"bad unit":                       {"#UNIT name_of_1_metric_seconds milli-seconds", parseErrorMalformed},
+		"bad name in metadata":           {"#HELP 1name Duration.", parseErrorBadName},
+		"too many parts":                 {"name_of_1_metric_seconds|h|1;2|labelA=x|labelB=y|1", parseErrorMalformed},
+		"not enough parts":               {"name_of_1_metric_total|1", parseErrorMalformed},
+		"negative counter":               {"name_of_1_metric_total|c|-1", parseErrorBadValue},
+		"infinite counter":               {"name_of_1_metric_total|c|+Inf", parseErrorBadValue},
+		"NaN histogram observation":      {"name_of_1_metric_seconds|h|1;2|NaN", parseErrorBadValue},
+		"infinite histogram observation": {"name_of_1_metric_seconds|hl|1;2;3|-Inf", parseErrorBadValue},
+		"empty unquoted label value":     {"name_of_1_metric_total|c|labelA=|1", parseErrorBadLabel},
+		"bad sample rate":                {"name_of_1_metric_total|c|1|@abc", parseErrorBadSampleRate},
+		"zero sample rate":               {"name_of_1_metric_total|c|1|@0", parseErrorBadSampleRate},
+		"sample rate below minimum":      {"name_of_1_metric_seconds|h|1;2|1|@1e-9", parseErrorBadSampleRate},
+		"sample rate above 1":            {"name_of_1_metric_total|c|labelA=x|1|@1.5", parseErrorBadSampleRate},
+		"too many parts with rate":       {"name_of_1_metric_seconds|h|1;2|labelA=x|labelB=y|1|@0.5", parseErrorMalformed},
+		"sample rate only":               {"name_of_1_metric_total|c|@0.5", parseErrorBadValue},
+		"quantile label in summary":      {"name_of_1_metric_seconds|s|quantile=x|1", parseErrorBadLabel},
+		"NaN summary observation":        {"name_of_1_metric_seconds|s|NaN", parseErrorBadValue},
+		"bad summary def":                {"name_of_1_metric_seconds|s|0.5:a|1", parseErrorBadSummaryDef},
+		"summary quantile above 1":       {"name_of_1_metric_seconds|s|1.5:0.01|labelA=x|1", parseErrorBadSummaryDef},
+		"summary negative max age":       {"name_of_1_metric_seconds|s|-1m|1", parseErrorBadSummaryDef},
+		"summary max age twice":          {"name_of_1_metric_seconds|s|1m;2m|labelA=x|1", parseErrorBadSummaryDef},
+		"misplaced shared labels":        {"service=srvA1\nname_of_1_metric_total|c|1\nservice=srvA2", parseErrorMisplacedSharedLabels},
+	}
+
+	for k, tc := range cases {
+		_, err := parseSample(strings.NewReader(tc.in))
+
+		invalid, ok := err.(batchErrors)
+		if !a.True(t, ok, "[%s] batchErrors expected, got: %v", k, err) || !a.Len(t, invalid, 1, k) {
+			continue
+		}
+		lines := strings.Split(tc.in, "\n")
+		a.Equal(t, tc.expReason, invalid[0].Reason, k)
+		a.Equal(t, len(lines), invalid[0].Line, k)
+		a.Equal(t, lines[len(lines)-1], invalid[0].Text, k)
+	}
+}
+
+func Test_SampleParser_Parse_EscapedLabelValues(t *testing.T) {
+	cases := map[string]struct {
+		in  string
+		exp map[string]string
+	}{
+		"escaped separators": {`name|c|path="/a\;b\|c"|1`, map[string]string{"path": "/a;b|c"}},
+		"escaped backslash":  {`name|c|path="a\\"|1`, map[string]string{"path": `a\`}},
+		"escaped new line":   {`name|c|query="a\nb";user=x|1`, map[string]string{"query": "a\nb", "user": "x"}},
+		"unknown escape":     {`name|c|path="C:\dir"|1`, map[string]string{"path": `C:\dir`}},
+		"unquoted backslash": {`name|c|path=C:\dir\n\;query=a\"|1`, map[string]string{"path": `C:\dir\n\`, "query": `a\"`}},
+		"trailing backslash": {`name|c|path=C:\|1`, map[string]string{"path": `C:\`}},
+		"quoted":             {`name|c|path="/a;b|c";user=x|1`, map[string]string{"path": "/a;b|c", "user": "x"}},
+		"quoted empty":       {`name|c|path=""|1`, map[string]string{"path": ""}},
+		"quoted with escape": {`name|c|agent="say \"hi\""|1`, map[string]string{"agent": `say "hi"`}},
+		"quote inside value": {`name|c|agent=a"b"|1`, map[string]string{"agent": `a"b"`}},
+		"histogram":          {`name|h|1;2|path="a;b"|1`, map[string]string{"path": "a;b"}},
+		"shared labels":      {"service=\"a|b\";path=\"x\\;y\"\nname|c|1", map[string]string{"service": "a|b", "path": "x;y"}},
+	}
+
+	for k, tc := range cases {
+		got, err := parseSample(strings.NewReader(tc.in))
+		if !a.NoError(t, err, k) || !a.Len(t, got, 1, k) {
+			continue
+		}
+		a.Equal(t, tc.exp, got[0].labels, k)
+		a.Equal(t, float64(1), got[0].value, k)
+	}
+}
+
+func Test_SampleParser_Parse_GaugeNaN(t *testing.T) {
+	got, err := parseSample(strings.NewReader("name_of_1_metric|g|NaN"))
+
+	if a.NoError(t, err) && a.Len(t, got, 1) {
+		a.Equal(t, sampleGauge, got[0].kind)
+		a.True(t, math.IsNaN(got[0].value))
+	}
+}
+
+func Test_SampleParser_Parse_ErrorsSkipped(t *testing.T) {
+	in := "service=srvA1\nname_of_1_metric_total|c|1\n\nname_of_1_metric_total|c|abc\nname_of_2_metric|g|2\n"
+
+	got, err := parseSample(strings.NewReader(in))
+
+	a.Len(t, got, 2)
+	invalid, ok := err.(batchErrors)
+	if a.True(t, ok, "batchErrors expected, got: %v", err) && a.Len(t, invalid, 1) {
+		a.Equal(t, &parseError{
+			Index: 3, Line: 4, Reason: parseErrorBadValue,
+			Message: `invalid value "abc"`, Text: "name_of_1_metric_total|c|abc",
+		}, invalid[0])
+	}
+}
+
+func Test_LineError_TextTruncated(t *testing.T) {
+	pe := lineError(newParseError(parseErrorBadName, "invalid"), 3, strings.Repeat("x", 2*parseErrorMaxTextLen))
+	a.Len(t, pe.Text, parseErrorMaxTextLen)
+	a.Equal(t, 3, pe.Line)
+	a.Equal(t, 2, pe.Index)
+}
+
+// thRegexpDivergenceRE matches lines parsed differently by reference and hand-written parser:
+//   - with histogram definition passed to counter or gauge; reference parser accepts them dropping labels
+//     or panics, hand-written one rejects them,
+//   - metadata lines and lines with sample rate, timestamp, summary, set, exponential or native histogram kind
+//     and gauge changes, which are not supported by reference parser.
+var thRegexpDivergenceRE = regexp.MustCompile(`^[^|]*\|[cg]\|[0-9.]+(;[0-9.]+)*\||\|[@T]|^[^|]*\|(s|he|hn|u|g\+|g-)\||^#`)
+
+// thNativeCorpus holds batches covering valid and invalid lines of the native format.
+var thNativeCorpus = []string{
+	"",
+	"\n\n",
+	"service=srvA1;host=hostA;phpVersion=5.6\nname_of_1_metric_total|c|labelA=labelValueA;label2=labelValue2|12.345\nname_of_2_metric_total|c|56\nname_of_3_metric|g|7.3",
+	"name_of_1_metric_seconds|hl|3.3;2.0;5|labelA=labelValueA;label2=labelValue2|12.345",
+	"name_of_2_metric_seconds|h|2.0;2.2;5;7|labelA=labelValueA;label2=labelValue2|12.345",
+	"name_of_2_metric_seconds|h|2.0;2.2|12.345\nname_of_2_metric_seconds|h|labelA=x|1\nname_of_2_metric_seconds|h|1",
+	"name|g|-7.3\nname|g|1.5e-7\nname|c|2E+3\nname|g|+Inf\nname|g|NaN\nname|g|0x1p-2\nname|g|1_000",
+	"name|c|-1\nname|c|+Inf\nname|c|NaN\nname|h|NaN\nname|hl|1;2;3|-Inf",
+	"1name|c|1\nname|x|1\nname|c|abc\nname|c|label-A=x|1\nn|c|1\n:name|c|1\nname:sub|c|1",
+	"name|h|0||0\nname|h|1;2|label-A=x|1\nname|h|1;2|le=x|1\nname|h|1;a|1\nname|hl|1;a;3|labelA=x|1\nname|h|1;;2|1\nname|h|;1|1\nname|h|1;|1",
+	"name|h|1;2|labelA=x|labelB=y|1\nname|c|1\nname|g|a=b|c=d|1\nname|1\n|\n||\n|||\nname||1\nname|c||1",
+	"service=srvA1\nname|c|1\nservice=srvA2",
+	"name|c|1\nservice=srvA1\nname|c|1",
+	"le=1\nname|h|1;2|1",
+	"name|hl|5|1\nname|hl|1;0;3|1\nname|hl|labelA=x|1\nname|hl|1\nname|h|5;1|1\nname|h|1;1|labelA=x|1",
+	"name|h|10;0|0|0\nname|hl|le=x|1\nle=0\nname|h|1;0|0",
+	`name|c|path=/a\;b\|c|1`,
+	`name|c|path=a\\|1`,
+	`name|c|query=a\nb;user=x|1`,
+	`name|c|path=C:\dir|1`,
+	`name|c|path="/a;b|c";user=x|1`,
+	`name|c|path=""|1`,
+	`name|c|path=|1`,
+	`name|c|path=;a=b|1`,
+	`name|c|agent="say \"hi\""|1`,
+	`name|c|agent=a"b"|1`,
+	`name|h|1;2|path="a;b"|1`,
+	"service=\"a|b\";path=x\\;y\nname|c|1",
+	`name|c|a=x\|1`,
+	`name|c|a=x\`,
+	`name|c|a="x`,
+	`name|c|a="x\"|1`,
+	`name|c|a="x"y|1`,
+	`name|c|a="x;b=y"|1`,
+	`name|c|a="x|y"z|1`,
+	`name|h|a="1|2"`,
+	`name|h|1;2|a="1|2"`,
+	`a="x|c|1"`,
+	`a="x";b`,
+	`name|c|a=1;a=2|1`,
+	"service=a;service=b\nname|c|service=c|1",
+	"name|c|a=b;|1\nname|c|;a=b|1\nname|c|a=b;;c=d|1\nname|c|a==b|1\nname|c|=b|1\nname|c|_a=b|1\nname|c|0a=b|1",
+	"name|c|1\r\nname|g|2\r\n",
+	"name|s|1\nname|s|0.5:0.05|1\nname|s|0.5:0.05;1m|a=b|1\nname|s|x|1\nname|s|1m|quantile=x|1\nname|s|Inf",
+	"name|c|1|@0.5\nname|c|1|@\nname|c|@0.5\nname|c|a=x|@0.5|1\nname|h|1;2|a=x|1|@1e-3\nname|c|1|@0.5|@0.5",
+	"name|c|1 \n name|c|1\nname|c| 1",
+	"name|c|a=\xff|1\nname|c|a=\\\xff|1\nname|c|a=\"\xe2\x82\xac\"|1\nname\xff|c|1",
+}
+
+// thSamplesStrings formats samples, so they can be compared including NaN values.
+func thSamplesStrings(samples []*sample) []string {
+	var out []string
+	for _, s := range samples {
+		out = append(out, fmt.Sprintf("%+v", *s))
+	}
+	return out
+}
+
+// thIsInvalidHistogramDef checks if histogram definition of the sample would panic in collector.
+func thIsInvalidHistogramDef(s *sample) bool {
+	def := []byte(strings.Join(s.histogramDef, sampleParserHistogramDefSeparator))
+	switch s.kind {
+	case sampleHistogram:
+		return len(def) > 0 && histogramDefError(def) != nil
+	case sampleHistogramLinear:
+		return linearDefError(def) != nil
+	}
+	return false
+}
+
+// thAssertSameAsRegexp checks that batch is parsed the same way by hand-written and reference parsers.
+func thAssertSameAsRegexp(t *testing.T, in string) {
+	var (
+		expSamples []*sample
+		expErr     error
+		panicked   bool
+	)
+	func() {
+		defer func() { panicked = recover() != nil }()
+		expSamples, expErr = parseSampleRegexp(strings.NewReader(in))
+	}()
+
+	for _, line := range strings.Split(in, "\n") {
+		if panicked || thRegexpDivergenceRE.MatchString(line) {
+			return
+		}
+	}
+	// reference parser accepts histogram definitions which panic in collector, hand-written one rejects them
+	for _, s := range expSamples {
+		if thIsInvalidHistogramDef(s) {
+			return
+		}
+	}
+
+	gotSamples, gotErr := parseSample(strings.NewReader(in))
+	a.Equal(t, thSamplesStrings(expSamples), thSamplesStrings(gotSamples), "%q", in)
+	a.Equal(t, expErr, gotErr, "%q", in)
+
+	// the same batch held in memory, with samples taken from the pool
+	gotSamples, gotErr = formatNative.parseBytes([]byte(in))
+	for _, s := range gotSamples {
+		a.True(t, s.pooled, "%q", in)
+		s.pooled = false
+	}
+	a.Equal(t, thSamplesStrings(expSamples), thSamplesStrings(gotSamples), "%q", in)
+	a.Equal(t, expErr, gotErr, "%q", in)
+}
+
+func Test_SampleParser_Parse_SameAsRegexp(t *testing.T) {
+	for _, in := range thNativeCorpus {
+		thAssertSameAsRegexp(t, in)
+	}
+
+	// each line on its own, so shared labels state does not hide differences
+	for _, in := range thNativeCorpus {
+		for _, line := range strings.Split(in, "\n") {
+			thAssertSameAsRegexp(t, line)
+			thAssertSameAsRegexp(t, "service=srvA1\n"+line)
+		}
+	}
+}
+
+func Test_SampleParser_Parse_RegexpDivergence(t *testing.T) {
+	for _, in := range []string{"name|c|1;2|a=b|5", "name|g|1;2|5", "name|c|1|5"} {
+		got, err := parseSample(strings.NewReader(in))
+		a.Empty(t, got, in)
+		a.Error(t, err, in)
+	}
+}
+
+func Fuzz_SampleParser_Parse_Regexp(f *testing.F) {
+	for _, in := range thNativeCorpus {
+		f.Add(in)
+	}
+	f.Fuzz(thAssertSameAsRegexp)
+}
+
+func Test_SampleParser_ParseBytes_ReusesPooledSamples(t *testing.T) {
+	got, err := formatNative.parseBytes([]byte("service=srvA1\nname_of_1_metric_seconds|h|1;2|labelA=x|1"))
+	if !a.NoError(t, err) || !a.Len(t, got, 1) {
+		return
+	}
+	a.Equal(t, map[string]string{"service": "srvA1", "labelA": "x"}, got[0].labels)
+
+	got[0].release()
+	a.Equal(t, sample{labels: map[string]string{}}, *got[0])
+}
+
+func Test_Sample_Release_NotPooled(t *testing.T) {
+	labels := map[string]string{"labelA": "x"}
+	s := &sample{name: "name_of_1_metric_total", kind: sampleCounter, labels: labels, value: 1}
+
+	s.release()
+
+	// labels may be shared with other samples, so they must stay untouched
+	a.Equal(t, &sample{name: "name_of_1_metric_total", kind: sampleCounter, labels: labels, value: 1}, s)
+	a.Equal(t, map[string]string{"labelA": "x"}, labels)
+}
+
+// thNativeBenchmarkPacket is a typical packet sent by PHP script.
+var thNativeBenchmarkPacket = []byte(`service=srvA1;host=hostA;phpVersion=5.6
+http_requests_total|c|path=/api/v1/products;method=GET;status=200|1
+http_request_duration_seconds|h|0.005;0.01;0.05;0.1;0.5;1|path=/api/v1/products;method=GET|0.042
+db_queries_total|c|table=products|12
+cache_hit_ratio|g|table=products|0.93
+memory_usage_bytes|g|2097152
+`)
+
+func Benchmark_SampleParser_Parse(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, _ = parseSample(bytes.NewReader(thNativeBenchmarkPacket))
+	}
+}
+
+func Benchmark_SampleParser_Parse_Regexp(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, _ = parseSampleRegexp(bytes.NewReader(thNativeBenchmarkPacket))
+	}
+}
+
+func Benchmark_SampleParser_ParseBytes_Pooled(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		samples, _ := formatNative.parseBytes(thNativeBenchmarkPacket)
+		for _, s := range samples {
+			s.release()
+		}
+	}
+}
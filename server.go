@@ -2,23 +2,55 @@ package main
 
 import (
 	"bytes"
+	"context"
+	stderrors "errors"
+	"fmt"
 	"net"
+	"strconv"
 	"time"
 
 	"github.com/pkg/errors"
 
 	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// transport* are values of transport label in server metrics.
+	transportUDP      = "udp"
+	transportTCP      = "tcp"
+	transportUnixgram = "unixgram"
+	transportHTTP     = "http"
+
+	// parseErrorsLogInterval is a minimal interval between logged parse errors.
+	parseErrorsLogInterval = time.Second
+
+	// readErrorRetryDelay is a pause after failed read of datagrams, so persistent errors
+	// do not result in busy loop.
+	readErrorRetryDelay = 10 * time.Millisecond
 )
 
 type sampleHandler func(samples *sample) error
 
 type server struct {
 	sampleHandler sampleHandler
-	buf           []byte
 
-	metricRequestsTotal           prometheus.Counter
-	metricSamplesTotal            prometheus.Counter
-	metricRequestHandlingDuration prometheus.Summary
+	// bufSize is a size of buffer in bytes used by each datagram listener
+	bufSize int
+
+	metricRequestsTotal           *prometheus.CounterVec
+	metricSamplesTotal            *prometheus.CounterVec
+	metricRequestHandlingDuration *prometheus.SummaryVec
+	metricReaderPacketsTotal      *prometheus.CounterVec
+	metricReaderBytesTotal        *prometheus.CounterVec
+	metricReaderErrorsTotal       *prometheus.CounterVec
+	metricParseErrorsTotal        *prometheus.CounterVec
+
+	// parseErrorsLog limits logging of invalid elements, as misbehaving client can flood the log
+	parseErrorsLog *logLimiter
+
+	// readErrorsLog limits logging of failed datagram reads
+	readErrorsLog *logLimiter
 }
 
 // newServer is factory for UDP server for incoming metrics data
@@ -27,69 +59,227 @@ type server struct {
 // bs is a UDP buffer size in bytes
 func newServer(handler sampleHandler, bs int) *server {
 	s := server{
-		sampleHandler: handler,
-		buf:           make([]byte, bs),
-		metricRequestsTotal: prometheus.NewCounter(
+		sampleHandler:  handler,
+		bufSize:        bs,
+		parseErrorsLog: newLogLimiter(parseErrorsLogInterval),
+		readErrorsLog:  newLogLimiter(parseErrorsLogInterval),
+		metricRequestsTotal: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
 				Name: "app_ingress_requests_total",
 				Help: "Number of request entering server.",
 			},
+			[]string{"transport"},
 		),
-		metricSamplesTotal: prometheus.NewCounter(
+		metricSamplesTotal: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
 				Name: "app_ingress_samples_total",
 				Help: "Number of samples entering server.",
 			},
+			[]string{"transport"},
 		),
-		metricRequestHandlingDuration: prometheus.NewSummary(
+		metricRequestHandlingDuration: prometheus.NewSummaryVec(
 			prometheus.SummaryOpts{
 				Name: "app_ingress_request_handling_duration_ns",
 				Help: "Time in ns spent on handling single request.",
 			},
+			[]string{"transport"},
+		),
+		metricReaderPacketsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "app_ingress_reader_packets_total",
+				Help: "Number of packets read by single datagram reader.",
+			},
+			[]string{"transport", "reader"},
+		),
+		metricReaderBytesTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "app_ingress_reader_bytes_total",
+				Help: "Number of bytes read by single datagram reader.",
+			},
+			[]string{"transport", "reader"},
+		),
+		metricReaderErrorsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "app_ingress_reader_errors_total",
+				Help: "Number of failed reads of single datagram reader.",
+			},
+			[]string{"transport", "reader"},
+		),
+		metricParseErrorsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "app_ingress_parse_errors_total",
+				Help: "Number of invalid elements (e.g. lines) skipped by server.",
+			},
+			[]string{"reason"},
 		),
 	}
 	prometheus.MustRegister(s.metricRequestsTotal)
 	prometheus.MustRegister(s.metricSamplesTotal)
 	prometheus.MustRegister(s.metricRequestHandlingDuration)
+	prometheus.MustRegister(s.metricReaderPacketsTotal)
+	prometheus.MustRegister(s.metricReaderBytesTotal)
+	prometheus.MustRegister(s.metricReaderErrorsTotal)
+	prometheus.MustRegister(s.metricParseErrorsTotal)
 	return &s
 }
 
-func (s *server) Listen(ip string, port int) error {
-	listenAddr := net.UDPAddr{
-		Port: port,
-		IP:   net.ParseIP(ip),
+// Listen starts UDP server with given number of readers.
+//
+// Each reader runs in a separate goroutine with its own socket and buffer.
+// With more than one reader sockets are bound with SO_REUSEPORT, so kernel spreads
+// incoming packets across them.
+// With batchSize bigger than 1 each reader reads up to batchSize packets with single syscall.
+// Where batched reads are not available packets are read one by one.
+// Packets are parsed according to format.
+func (s *server) Listen(ip string, port int, readers int, batchSize int, format *sampleFormat) error {
+	if readers < 1 {
+		return errors.Errorf("invalid number of readers: %d", readers)
 	}
-	conn, err := net.ListenUDP("udp", &listenAddr)
-	if err != nil {
-		return errors.Wrap(err, "opening server socket failed")
+	if batchSize < 1 {
+		return errors.Errorf("invalid batch size: %d", batchSize)
+	}
+	if readers > 1 && !reusePortSupported {
+		return errors.New("multiple readers require SO_REUSEPORT, which is not supported on this platform")
 	}
 
-	go func() {
-		var (
-			reader *bytes.Reader
-			tS     time.Time
-		)
+	lc := net.ListenConfig{}
+	if readers > 1 {
+		lc.Control = reusePortControl
+	}
 
-		for {
-			n, _, _ := conn.ReadFromUDP(s.buf)
+	listenAddr := net.JoinHostPort(ip, strconv.Itoa(port))
+	for i := 0; i < readers; i++ {
+		conn, err := lc.ListenPacket(context.Background(), "udp", listenAddr)
+		if err != nil {
+			return errors.Wrap(err, "opening server socket failed")
+		}
 
-			tS = time.Now()
+		// there can be multiple UDP servers, so address keeps reader id unique
+		reader := listenAddr + "/" + strconv.Itoa(i)
 
-			s.metricRequestsTotal.Inc()
+		if batchSize > 1 && udpBatchSupported {
+			go s.serveDatagramsBatch(conn, transportUDP, reader, batchSize, format)
+		} else {
+			go s.serveDatagrams(conn, transportUDP, reader, format)
+		}
+	}
 
-			reader = bytes.NewReader(s.buf[:n])
+	return nil
+}
 
-			samples, _ := parseSample(reader)
+// serveDatagrams reads packets from connection and passes them for handling.
+// Each packet is a separate batch of samples.
+// reader identifies the reader in metrics. It returns when connection is closed.
+func (s *server) serveDatagrams(conn net.PacketConn, transport, reader string, format *sampleFormat) {
+	buf := make([]byte, s.bufSize)
 
-			s.metricSamplesTotal.Add(float64(len(samples)))
+	packetsTotal := s.metricReaderPacketsTotal.WithLabelValues(transport, reader)
+	bytesTotal := s.metricReaderBytesTotal.WithLabelValues(transport, reader)
 
-			for _, sample := range samples {
-				_ = s.sampleHandler(sample)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if !s.handleReadError(transport, reader, err) {
+				return
 			}
+			continue
+		}
+
+		packetsTotal.Inc()
+		bytesTotal.Add(float64(n))
+
+		s.handlePacket(buf[:n], transport, format)
+	}
+}
+
+// handleReadError accounts failed read of datagram reader and reports whether reading should be retried.
+// Reading stops when connection is closed. Other errors are retried after readErrorRetryDelay,
+// as they may be persistent.
+func (s *server) handleReadError(transport, reader string, err error) bool {
+	if stderrors.Is(err, net.ErrClosed) {
+		log.Debugf("Server: %s reader %s stopped, connection closed", transport, reader)
+		return false
+	}
+
+	s.metricReaderErrorsTotal.WithLabelValues(transport, reader).Inc()
+	if suppressed, ok := s.readErrorsLog.allow(1); ok {
+		log.Errorf("Server: %s reader %s failed to read (%d errors suppressed since last log): %s", transport, reader, suppressed, err)
+	}
+	time.Sleep(readErrorRetryDelay)
+	return true
+}
+
+// handlePacket parses single packet and passes samples to sampleHandler.
+func (s *server) handlePacket(packet []byte, transport string, format *sampleFormat) {
+	tS := time.Now()
 
-			s.metricRequestHandlingDuration.Observe(float64(time.Since(tS).Nanoseconds()))
+	s.metricRequestsTotal.WithLabelValues(transport).Inc()
+
+	var (
+		samples []*sample
+		err     error
+	)
+	if format.parseBytes != nil {
+		samples, err = format.parseBytes(packet)
+	} else {
+		samples, err = format.parse(bytes.NewReader(packet))
+	}
+	if err != nil {
+		s.reportParseErrors(transport, err)
+	}
+
+	s.metricSamplesTotal.WithLabelValues(transport).Add(float64(len(samples)))
+
+	s.handleSamples(transport, samples)
+
+	s.metricRequestHandlingDuration.WithLabelValues(transport).Observe(float64(time.Since(tS).Nanoseconds()))
+}
+
+// handleSamples passes samples to sampleHandler.
+// Samples rejected by the handler are released, as no one else refers to them.
+func (s *server) handleSamples(transport string, samples []*sample) {
+	for _, sample := range s.dropInvalidSamples(transport, samples) {
+		if err := s.sampleHandler(sample); err != nil {
+			sample.release()
 		}
-	}()
+	}
+}
 
-	return nil
+// dropInvalidSamples removes samples which can not be handled by collector, e.g. histograms with "le" label.
+// Most formats reject them while parsing, it covers the others. Removed samples are released and reported
+// as parse errors. Valid samples are kept in the backing array of samples.
+func (s *server) dropInvalidSamples(transport string, samples []*sample) []*sample {
+	var invalid batchErrors
+	valid := samples[:0]
+	for _, sample := range samples {
+		if pe := sample.reservedLabelError(); pe != nil {
+			pe.Message = fmt.Sprintf("%s: %s", sample.name, pe.Message)
+			invalid = append(invalid, pe)
+			sample.release()
+			continue
+		}
+		valid = append(valid, sample)
+	}
+
+	if len(invalid) > 0 {
+		s.reportParseErrors(transport, invalid)
+	}
+	return valid
+}
+
+// reportParseErrors counts invalid elements reported by format and logs some of them on debug level.
+// Errors other than batchErrors mean that the whole batch is malformed.
+func (s *server) reportParseErrors(transport string, err error) {
+	invalid, ok := err.(batchErrors)
+	if !ok {
+		invalid = batchErrors{newParseError(parseErrorMalformed, "%s", err)}
+	}
+
+	for _, pe := range invalid {
+		s.metricParseErrorsTotal.WithLabelValues(string(pe.Reason)).Inc()
+	}
+
+	if suppressed, ok := s.parseErrorsLog.allow(len(invalid)); ok {
+		log.Debugf("Server: invalid input over %s (%d errors suppressed since last log): %s", transport, suppressed, invalid[0])
+	}
 }
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+)
+
+// serveDatagramsBatch reads packets from UDP connection in batches of up to batchSize packets.
+// On Linux single batch is read with one recvmmsg syscall. Each message in the batch has its own,
+// preallocated buffer, which is reused between reads.
+// Packets and read errors are handled the same way as in serveDatagrams.
+func (s *server) serveDatagramsBatch(conn net.PacketConn, transport, reader string, batchSize int, format *sampleFormat) {
+	// ipv4.Message is the same type as ipv6.Message and reading payloads
+	// does not depend on the address family of the socket.
+	pc := ipv4.NewPacketConn(conn)
+
+	ms := make([]ipv4.Message, batchSize)
+	for i := range ms {
+		ms[i].Buffers = [][]byte{make([]byte, s.bufSize)}
+	}
+
+	packetsTotal := s.metricReaderPacketsTotal.WithLabelValues(transport, reader)
+	bytesTotal := s.metricReaderBytesTotal.WithLabelValues(transport, reader)
+
+	for {
+		n, err := pc.ReadBatch(ms, 0)
+		if err != nil {
+			if !s.handleReadError(transport, reader, err) {
+				return
+			}
+			continue
+		}
+
+		for i := 0; i < n; i++ {
+			packetsTotal.Inc()
+			bytesTotal.Add(float64(ms[i].N))
+
+			s.handlePacket(ms[i].Buffers[0][:ms[i].N], transport, format)
+		}
+	}
+}
@@ -0,0 +1,4 @@
+package main
+
+// udpBatchSupported reports if UDP packets can be read in batches with single syscall.
+const udpBatchSupported = true
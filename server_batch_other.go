@@ -0,0 +1,6 @@
+//go:build !linux
+
+package main
+
+// udpBatchSupported reports if UDP packets can be read in batches with single syscall.
+const udpBatchSupported = false
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// otlpContentType is a content type of OTLP/HTTP requests and responses with protobuf encoding.
+	otlpContentType = "application/x-protobuf"
+
+	// remoteWriteSamplesWrittenHeader is a response header with number of samples written by remote write receiver.
+	remoteWriteSamplesWrittenHeader = "X-Prometheus-Remote-Write-Samples-Written"
+)
+
+// ingestResponse is a body of the response for samples pushed over HTTP.
+type ingestResponse struct {
+	// Accepted is a number of samples queued for processing.
+	Accepted int `json:"accepted"`
+
+	// Rejected is a number of samples not queued for processing, e.g. due to full ingress queue.
+	Rejected int `json:"rejected"`
+
+	// Errors describes invalid elements of the batch, which were skipped.
+	// It's reported only by formats able to recognize elements of the batch, e.g. JSON.
+	Errors batchErrors `json:"errors,omitempty"`
+}
+
+// ingestHandler creates HTTP handler accepting batch of samples in request body with POST method.
+//
+// Body is parsed according to format, which can be overridden per request with "format" query parameter.
+// Response holds number of accepted and rejected samples and invalid elements of the batch, if format reports them.
+// Service Unavailable status is returned only when all samples were rejected, so the batch can be retried.
+// Partially taken batch is not, as accepted samples would be counted twice on retry.
+// maxBodySize limits size of the request body in bytes.
+func (s *server) ingestHandler(maxBodySize int64, format *sampleFormat) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requirePost(w, r) {
+			return
+		}
+
+		reqFormat := format
+		if name := r.URL.Query().Get("format"); name != "" {
+			var err error
+			if reqFormat, err = lookupSampleFormat(name); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		resp, ok := s.ingest(w, r, maxBodySize, reqFormat)
+		if !ok {
+			return
+		}
+
+		status := http.StatusOK
+		if resp.Rejected > 0 && resp.Accepted == 0 {
+			status = http.StatusServiceUnavailable
+		}
+
+		writeJSON(w, status, resp)
+	}
+}
+
+// influxWriteHandler creates HTTP handler compatible with InfluxDB write endpoint.
+//
+// It works as ingestHandler, but responds the way InfluxDB clients expect:
+// No Content status on success and error message in JSON otherwise. Partially taken batch is responded
+// with Bad Request, as InfluxDB does for partial writes, so clients do not retry it and count accepted points twice.
+// Batch with invalid lines is responded with Bad Request and the first parse error, whether any point was accepted or not.
+func (s *server) influxWriteHandler(maxBodySize int64, format *sampleFormat) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requirePost(w, r) {
+			return
+		}
+
+		resp, ok := s.ingest(w, r, maxBodySize, format)
+		if !ok {
+			return
+		}
+
+		if len(resp.Errors) > 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{
+				"error": fmt.Sprintf("partial write: unable to parse %d lines: %s", len(resp.Errors), resp.Errors[0]),
+			})
+			return
+		}
+		if resp.Rejected > 0 && resp.Accepted == 0 {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{
+				"error": fmt.Sprintf("%d of %d points rejected", resp.Rejected, resp.Rejected),
+			})
+			return
+		}
+		if resp.Rejected > 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{
+				"error": fmt.Sprintf("partial write: %d of %d points rejected", resp.Rejected, resp.Rejected+resp.Accepted),
+			})
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// ingest parses body of the request with format and passes samples to sampleHandler.
+// Gzip compressed body is accepted. Both compressed and decompressed body is limited to maxBodySize bytes.
+// When body can not be read, error response is written and ok is false.
+func (s *server) ingest(w http.ResponseWriter, r *http.Request, maxBodySize int64, format *sampleFormat) (resp ingestResponse, ok bool) {
+	tS := time.Now()
+	s.metricRequestsTotal.WithLabelValues(transportHTTP).Inc()
+
+	var body io.ReadCloser = http.MaxBytesReader(w, r.Body, maxBodySize)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return resp, false
+		}
+		defer gz.Close()
+		body = http.MaxBytesReader(w, gz, maxBodySize)
+	}
+
+	var (
+		samples []*sample
+		err     error
+	)
+	if format.parseFrom != nil {
+		samples, err = format.parseFrom(body, requestSender(r))
+	} else {
+		samples, err = format.parse(body)
+	}
+	if invalid, ok := err.(batchErrors); ok {
+		s.reportParseErrors(transportHTTP, invalid)
+		resp.Errors = invalid
+		err = nil
+	}
+	if err != nil {
+		status := http.StatusBadRequest
+		if _, ok := err.(*http.MaxBytesError); ok {
+			status = http.StatusRequestEntityTooLarge
+		} else {
+			s.reportParseErrors(transportHTTP, err)
+		}
+		http.Error(w, err.Error(), status)
+		return resp, false
+	}
+
+	s.metricSamplesTotal.WithLabelValues(transportHTTP).Add(float64(len(samples)))
+
+	for _, sample := range s.dropInvalidSamples(transportHTTP, samples) {
+		if err := s.sampleHandler(sample); err != nil {
+			resp.Rejected++
+			continue
+		}
+		resp.Accepted++
+	}
+
+	s.metricRequestHandlingDuration.WithLabelValues(transportHTTP).Observe(float64(time.Since(tS).Nanoseconds()))
+
+	return resp, true
+}
+
+// requestSender returns host of the client which sent the request.
+// Port is omitted, as it changes with each connection of the same client.
+func requestSender(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// requirePost responds with Method Not Allowed status to requests other than POST.
+func requirePost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+// writeJSON writes response with v encoded as JSON.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Debugf("HTTP ingest: writing response failed: %s", err)
+	}
+}
+
+// otlpMetricsHandler creates HTTP handler implementing OTLP/HTTP metrics export endpoint with protobuf encoding.
+//
+// Samples rejected by sampleHandler are reported in partial success of the response.
+// Cumulative values were already accounted in such case, so export can not be retried.
+func (s *server) otlpMetricsHandler(maxBodySize int64, format *sampleFormat) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requirePost(w, r) {
+			return
+		}
+
+		if ct := r.Header.Get("Content-Type"); ct != otlpContentType {
+			http.Error(w, fmt.Sprintf("unsupported content type %q, expected %q", ct, otlpContentType), http.StatusUnsupportedMediaType)
+			return
+		}
+
+		resp, ok := s.ingest(w, r, maxBodySize, format)
+		if !ok {
+			return
+		}
+
+		out := &colmetricspb.ExportMetricsServiceResponse{}
+		if resp.Rejected > 0 {
+			out.PartialSuccess = &colmetricspb.ExportMetricsPartialSuccess{
+				RejectedDataPoints: int64(resp.Rejected),
+				ErrorMessage:       ErrIngressQueueFull.Error(),
+			}
+		}
+
+		body, err := proto.Marshal(out)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", otlpContentType)
+		w.Write(body)
+	}
+}
+
+// remoteWriteHandler creates HTTP handler implementing Prometheus remote write receiver.
+//
+// Response holds numbers of accepted and rejected samples and invalid series of the request.
+// Success status is returned even if some samples were rejected, as counter values were already
+// accounted and retried request would be counted twice.
+func (s *server) remoteWriteHandler(maxBodySize int64, format *sampleFormat) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requirePost(w, r) {
+			return
+		}
+
+		resp, ok := s.ingest(w, r, maxBodySize, format)
+		if !ok {
+			return
+		}
+
+		w.Header().Set(remoteWriteSamplesWrittenHeader, strconv.Itoa(resp.Accepted))
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// tcpAcceptRetryDelay is a pause after failed accept, so errors like running out
+	// of file descriptors do not result in busy loop.
+	tcpAcceptRetryDelay = 10 * time.Millisecond
+
+	// tcpInitialBufferSize is initial size of per connection read buffer in bytes.
+	// Buffer grows up to max line size when needed.
+	tcpInitialBufferSize = 4096
+)
+
+// ListenTCP starts TCP server accepting long-lived connections with stream of samples.
+//
+// Samples are sent in the same, new-line terminated, format as in UDP packets.
+// Each connection is a sequence of batches separated by an empty line. Shared labels line
+// is allowed as the first line of every batch and applies to all samples in that batch.
+// Lines longer than maxLineSize bytes terminate the connection, as well as not sending anything for idleTimeout.
+// Zero idleTimeout disables the timeout. Connections above maxConns are closed right after accepting.
+// Lines are parsed according to format, which must be line based.
+func (s *server) ListenTCP(ip string, port int, maxLineSize int, maxConns int, idleTimeout time.Duration, format *sampleFormat) error {
+	if format.newLineParser == nil {
+		return errors.Errorf("format %s can not be streamed", format.name)
+	}
+	if maxConns < 1 {
+		return errors.New("max connections must be positive")
+	}
+
+	listenAddr := net.TCPAddr{
+		Port: port,
+		IP:   net.ParseIP(ip),
+	}
+	ln, err := net.ListenTCP("tcp", &listenAddr)
+	if err != nil {
+		return errors.Wrap(err, "opening server socket failed")
+	}
+
+	conns := make(chan struct{}, maxConns)
+	go func() {
+		for {
+			conn, err := ln.AcceptTCP()
+			if err != nil {
+				log.Errorf("TCP server: accepting connection failed: %s", err)
+				time.Sleep(tcpAcceptRetryDelay)
+				continue
+			}
+
+			select {
+			case conns <- struct{}{}:
+			default:
+				log.Debugf("TCP server: connection from %s rejected, limit of %d connections reached", conn.RemoteAddr(), maxConns)
+				conn.Close()
+				continue
+			}
+
+			go func() {
+				s.handleTCPConn(conn, maxLineSize, idleTimeout, format)
+				<-conns
+			}()
+		}
+	}()
+
+	return nil
+}
+
+// handleTCPConn reads samples from single connection until it's closed by the client or idle for idleTimeout.
+func (s *server) handleTCPConn(conn net.Conn, maxLineSize int, idleTimeout time.Duration, format *sampleFormat) {
+	defer conn.Close()
+
+	var (
+		p        = format.newLineParser()
+		samples  []*sample
+		err      error
+		lineNo   int
+		inBatch  bool
+		duration time.Duration
+		tS       time.Time
+	)
+
+	// batchDone closes current batch, the same way as single UDP packet is accounted.
+	batchDone := func() {
+		if !inBatch {
+			return
+		}
+		s.metricRequestsTotal.WithLabelValues(transportTCP).Inc()
+		s.metricRequestHandlingDuration.WithLabelValues(transportTCP).Observe(float64(duration.Nanoseconds()))
+
+		p = format.newLineParser()
+		inBatch = false
+		duration = 0
+	}
+
+	// token size is limited by the larger of max and initial buffer capacity
+	bufSize := tcpInitialBufferSize
+	if maxLineSize < bufSize {
+		bufSize = maxLineSize
+	}
+	var r io.Reader = conn
+	if idleTimeout > 0 {
+		r = idleTimeoutReader{conn: conn, timeout: idleTimeout}
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, bufSize), maxLineSize)
+
+	for scanner.Scan() {
+		tS = time.Now()
+		lineNo++
+
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			batchDone()
+			continue
+		}
+		inBatch = true
+
+		if samples, err = parseLineWith(p, line, samples[:0]); err != nil {
+			s.reportParseErrors(transportTCP, batchErrors{lineError(err, lineNo, string(line))})
+		}
+		s.metricSamplesTotal.WithLabelValues(transportTCP).Add(float64(len(samples)))
+		s.handleSamples(transportTCP, samples)
+
+		duration += time.Since(tS)
+	}
+	batchDone()
+
+	if err := scanner.Err(); err != nil {
+		log.Debugf("TCP server: connection from %s closed: %s", conn.RemoteAddr(), err)
+	}
+}
+
+// idleTimeoutReader reads from connection, failing when no data arrives within timeout.
+type idleTimeoutReader struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+// Read implements io.Reader.
+func (r idleTimeoutReader) Read(b []byte) (int, error) {
+	if err := r.conn.SetReadDeadline(time.Now().Add(r.timeout)); err != nil {
+		return 0, err
+	}
+	return r.conn.Read(b)
+}
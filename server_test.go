@@ -0,0 +1,595 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	a "github.com/stretchr/testify/assert"
+)
+
+// thInitRegistry replaces default prometheus registry, so servers can be created multiple times.
+func thInitRegistry() func() {
+	registererOld := prometheus.DefaultRegisterer
+	prometheus.DefaultRegisterer = prometheus.NewRegistry()
+	return func() {
+		prometheus.DefaultRegisterer = registererOld
+	}
+}
+
+// thSampleRecorder collects samples passed to sampleHandler.
+type thSampleRecorder struct {
+	mu      sync.Mutex
+	samples []sample
+}
+
+func (r *thSampleRecorder) handle(s *sample) error {
+	r.mu.Lock()
+	r.samples = append(r.samples, *s)
+	r.mu.Unlock()
+	return nil
+}
+
+func Test_Server_HandleTCPConn_Batches(t *testing.T) {
+	defer thInitRegistry()()
+
+	rec := &thSampleRecorder{}
+	s := newServer(rec.handle, 1024)
+
+	client, srv := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		s.handleTCPConn(srv, 1024, time.Minute, formatNative)
+		close(done)
+	}()
+
+	client.Write([]byte(`service=srvA1
+name_of_1_metric_total|c|labelA=labelValueA|12.345
+name_of_2_metric|g|56
+
+name_of_1_metric_total|c|1
+`))
+	client.Close()
+	<-done
+
+	exp := []sample{
+		{
+			name: "name_of_1_metric_total", kind: sampleCounter,
+			labels: map[string]string{"service": "srvA1", "labelA": "labelValueA"},
+			value:  12.345,
+		},
+		{
+			name: "name_of_2_metric", kind: sampleGauge,
+			labels: map[string]string{"service": "srvA1"},
+			value:  56,
+		},
+		{
+			// shared labels are not carried over to the next batch
+			name: "name_of_1_metric_total", kind: sampleCounter,
+			labels: map[string]string{},
+			value:  1,
+		},
+	}
+	a.Equal(t, exp, rec.samples)
+}
+
+func Test_Server_HandleTCPConn_LineTooLong(t *testing.T) {
+	defer thInitRegistry()()
+
+	rec := &thSampleRecorder{}
+	s := newServer(rec.handle, 1024)
+
+	client, srv := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		s.handleTCPConn(srv, 32, time.Minute, formatNative)
+		close(done)
+	}()
+
+	go func() {
+		client.Write([]byte("name_of_2_metric|g|56\nname_of_1_metric_total|c|labelA=labelValueA|12.345\nname_of_2_metric|g|57\n"))
+		client.Close()
+	}()
+	<-done
+
+	if a.Len(t, rec.samples, 1) {
+		a.Equal(t, float64(56), rec.samples[0].value)
+	}
+}
+
+func Test_Server_HandleTCPConn_IdleTimeout(t *testing.T) {
+	defer thInitRegistry()()
+
+	rec := &thSampleRecorder{}
+	s := newServer(rec.handle, 1024)
+
+	client, srv := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		s.handleTCPConn(srv, 1024, 50*time.Millisecond, formatNative)
+		close(done)
+	}()
+
+	client.Write([]byte("name_of_2_metric|g|56\n"))
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("idle connection not closed")
+	}
+	if a.Len(t, rec.samples, 1) {
+		a.Equal(t, float64(56), rec.samples[0].value)
+	}
+}
+
+func Test_Server_IngestHandler(t *testing.T) {
+	body := `service=srvA1
+name_of_1_metric_total|c|labelA=labelValueA|12.345
+name_of_2_metric|g|56
+`
+	cases := map[string]struct {
+		method     string
+		handlerErr error
+		rejectFrom int
+		expStatus  int
+		expBody    string
+		expSamples int
+	}{
+		"accepted":     {http.MethodPost, nil, 0, http.StatusOK, `{"accepted":2,"rejected":0}` + "\n", 2},
+		"queue full":   {http.MethodPost, ErrIngressQueueFull, 0, http.StatusServiceUnavailable, `{"accepted":0,"rejected":2}` + "\n", 2},
+		"partial":      {http.MethodPost, ErrIngressQueueFull, 1, http.StatusOK, `{"accepted":1,"rejected":1}` + "\n", 2},
+		"wrong method": {http.MethodGet, nil, 0, http.StatusMethodNotAllowed, "method not allowed\n", 0},
+	}
+
+	for k, tc := range cases {
+		func() {
+			defer thInitRegistry()()
+
+			var samplesGot int
+			s := newServer(func(*sample) error {
+				samplesGot++
+				if samplesGot <= tc.rejectFrom {
+					return nil
+				}
+				return tc.handlerErr
+			}, 1024)
+
+			w := httptest.NewRecorder()
+			s.ingestHandler(1024, formatNative)(w, httptest.NewRequest(tc.method, "/ingest", strings.NewReader(body)))
+
+			a.Equal(t, tc.expStatus, w.Code, k)
+			a.Equal(t, tc.expBody, w.Body.String(), k)
+			a.Equal(t, tc.expSamples, samplesGot, k)
+		}()
+	}
+}
+
+func Test_Server_IngestHandler_Format(t *testing.T) {
+	defer thInitRegistry()()
+
+	rec := &thSampleRecorder{}
+	s := newServer(rec.handle, 1024)
+
+	w := httptest.NewRecorder()
+	s.ingestHandler(1024, formatNative)(w, httptest.NewRequest(http.MethodPost, "/ingest?format=statsd", strings.NewReader("requests:1|c\n")))
+	a.Equal(t, http.StatusOK, w.Code)
+	a.Equal(t, []sample{{name: "requests", kind: sampleCounter, labels: map[string]string{}, value: 1}}, rec.samples)
+
+	w = httptest.NewRecorder()
+	s.ingestHandler(1024, formatNative)(w, httptest.NewRequest(http.MethodPost, "/ingest?format=unknown", strings.NewReader("requests:1|c\n")))
+	a.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func Test_Server_ListenTCP_NotLineFormat(t *testing.T) {
+	defer thInitRegistry()()
+
+	s := newServer(func(*sample) error { return nil }, 1024)
+	a.Error(t, s.ListenTCP("127.0.0.1", 0, 1024, 1, time.Minute, &sampleFormat{name: "document"}))
+}
+
+func Test_Server_ListenTCP_InvalidMaxConnections(t *testing.T) {
+	defer thInitRegistry()()
+
+	s := newServer(func(*sample) error { return nil }, 1024)
+	a.Error(t, s.ListenTCP("127.0.0.1", 0, 1024, 0, time.Minute, formatNative))
+}
+
+func Test_Server_IngestHandler_BodyTooLarge(t *testing.T) {
+	defer thInitRegistry()()
+
+	var samplesGot int
+	s := newServer(func(*sample) error {
+		samplesGot++
+		return nil
+	}, 1024)
+
+	w := httptest.NewRecorder()
+	s.ingestHandler(16, formatNative)(w, httptest.NewRequest(http.MethodPost, "/ingest", strings.NewReader("name_of_2_metric|g|56\nname_of_2_metric|g|57\n")))
+
+	a.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	a.Equal(t, 0, samplesGot)
+}
+
+func Test_Server_ListenUnixgram(t *testing.T) {
+	defer thInitRegistry()()
+
+	path := filepath.Join(t.TempDir(), "aggregator.sock")
+
+	// stale socket left by previous run
+	stale, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if !a.NoError(t, err) {
+		t.FailNow()
+	}
+	stale.Close()
+	if _, err := os.Stat(path); !a.NoError(t, err) {
+		t.FailNow()
+	}
+
+	samplesCh := make(chan *sample, 1)
+	s := newServer(func(smp *sample) error {
+		samplesCh <- smp
+		return nil
+	}, 1024)
+
+	if !a.NoError(t, s.ListenUnixgram(path, 0600, formatNative)) {
+		t.FailNow()
+	}
+
+	fi, err := os.Stat(path)
+	if a.NoError(t, err) {
+		a.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	}
+
+	// second listener on the same path must not remove active socket
+	a.Error(t, s.ListenUnixgram(path, 0600, formatNative))
+
+	conn, err := net.Dial("unixgram", path)
+	if !a.NoError(t, err) {
+		t.FailNow()
+	}
+	defer conn.Close()
+	conn.Write([]byte("name_of_2_metric|g|56\n"))
+
+	select {
+	case smp := <-samplesCh:
+		a.Equal(t, sample{name: "name_of_2_metric", kind: sampleGauge, labels: map[string]string{}, value: 56, pooled: true}, *smp)
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for sample")
+	}
+}
+
+func Test_Server_ListenUnixgram_NotSocket(t *testing.T) {
+	defer thInitRegistry()()
+
+	path := filepath.Join(t.TempDir(), "aggregator.sock")
+	a.NoError(t, ioutil.WriteFile(path, []byte("data"), 0600))
+
+	s := newServer(func(*sample) error { return nil }, 1024)
+	a.Error(t, s.ListenUnixgram(path, 0600, formatNative))
+
+	// regular file is left untouched
+	_, err := os.Stat(path)
+	a.NoError(t, err)
+}
+
+// thFreeUDPPort finds UDP port not used on loopback interface.
+func thFreeUDPPort(t testing.TB) int {
+	probe, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer probe.Close()
+	return probe.LocalAddr().(*net.UDPAddr).Port
+}
+
+func Test_Server_Listen(t *testing.T) {
+	cases := map[string]struct {
+		readers   int
+		batchSize int
+	}{
+		"single reader":            {1, 1},
+		"multiple readers":         {4, 1},
+		"batched reads":            {1, 16},
+		"multiple batched readers": {4, 16},
+	}
+
+	for k, tc := range cases {
+		if tc.readers > 1 && !reusePortSupported {
+			continue
+		}
+
+		func() {
+			defer thInitRegistry()()
+
+			port := thFreeUDPPort(t)
+
+			samplesCh := make(chan *sample, 100)
+			s := newServer(func(smp *sample) error {
+				samplesCh <- smp
+				return nil
+			}, 1024)
+
+			if !a.NoError(t, s.Listen("127.0.0.1", port, tc.readers, tc.batchSize, formatNative), k) {
+				return
+			}
+
+			packets := 20
+			for i := 0; i < packets; i++ {
+				conn, err := net.Dial("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+				if !a.NoError(t, err, k) {
+					return
+				}
+				conn.Write([]byte("name_of_2_metric|g|" + strconv.Itoa(i) + "\n"))
+				conn.Close()
+			}
+
+			for i := 0; i < packets; i++ {
+				select {
+				case smp := <-samplesCh:
+					a.Equal(t, "name_of_2_metric", smp.name, k)
+				case <-time.After(time.Second):
+					t.Fatalf("[%s] timeout waiting for sample no. %d", k, i)
+				}
+			}
+		}()
+	}
+}
+
+// thFailingPacketConn fails reads with err until failures run out, then reports closed connection.
+type thFailingPacketConn struct {
+	net.PacketConn
+	err      error
+	failures int
+}
+
+func (c *thFailingPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	if c.failures == 0 {
+		return 0, nil, &net.OpError{Op: "read", Net: "udp", Err: net.ErrClosed}
+	}
+	c.failures--
+	return 0, nil, c.err
+}
+
+func Test_Server_ServeDatagrams_ReadErrors(t *testing.T) {
+	defer thInitRegistry()()
+
+	rec := &thSampleRecorder{}
+	s := newServer(rec.handle, 1024)
+	conn := &thFailingPacketConn{err: errors.New("read failed"), failures: 3}
+
+	done := make(chan struct{})
+	go func() {
+		s.serveDatagrams(conn, transportUDP, "0", formatNative)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("reader not stopped on closed connection")
+	}
+
+	var mm dto.Metric
+	s.metricReaderErrorsTotal.WithLabelValues(transportUDP, "0").Write(&mm)
+	a.Equal(t, float64(3), mm.Counter.GetValue())
+	s.metricReaderPacketsTotal.WithLabelValues(transportUDP, "0").Write(&mm)
+	a.Equal(t, float64(0), mm.Counter.GetValue())
+	a.Empty(t, rec.samples)
+}
+
+func Test_Server_ServeDatagramsBatch_Closed(t *testing.T) {
+	defer thInitRegistry()()
+
+	s := newServer(func(*sample) error { return nil }, 1024)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if !a.NoError(t, err) {
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.serveDatagramsBatch(conn, transportUDP, "0", 16, formatNative)
+		close(done)
+	}()
+	conn.Close()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("reader not stopped on closed connection")
+	}
+}
+
+func Test_Server_Listen_InvalidReaders(t *testing.T) {
+	defer thInitRegistry()()
+
+	s := newServer(func(*sample) error { return nil }, 1024)
+	a.Error(t, s.Listen("127.0.0.1", 0, 0, 1, formatNative))
+	a.Error(t, s.Listen("127.0.0.1", 0, 1, 0, formatNative))
+}
+
+// benchmarkServerListen measures handling of UDP packets flooding single reader.
+func benchmarkServerListen(b *testing.B, batchSize int) {
+	defer thInitRegistry()()
+
+	port := thFreeUDPPort(b)
+
+	var handled int
+	doneCh := make(chan struct{})
+	s := newServer(func(*sample) error {
+		handled++
+		if handled == b.N {
+			close(doneCh)
+		}
+		return nil
+	}, 1024)
+
+	if err := s.Listen("127.0.0.1", port, 1, batchSize, formatNative); err != nil {
+		b.Fatal(err)
+	}
+
+	conn, err := net.Dial("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	packet := []byte("name_of_2_metric|g|56\n")
+
+	b.ResetTimer()
+
+	// packets can be dropped, so keep sending until all expected are handled
+	for {
+		select {
+		case <-doneCh:
+			return
+		default:
+			conn.Write(packet)
+		}
+	}
+}
+
+func Benchmark_Server_Listen_Loop(b *testing.B) {
+	benchmarkServerListen(b, 1)
+}
+
+func Benchmark_Server_Listen_Batch(b *testing.B) {
+	if !udpBatchSupported {
+		b.Skip("batched reads not supported")
+	}
+	benchmarkServerListen(b, 64)
+}
+
+func Test_Server_InfluxWriteHandler(t *testing.T) {
+	body := "cpu,host=serverA usage=92.5\nmem,host=serverA free=1024i\n"
+	cases := map[string]struct {
+		body       string
+		handlerErr error
+		rejectFrom int
+		expStatus  int
+		expBody    string
+	}{
+		"all invalid": {
+			body: "cpu,host=serverA\nmem free\n", expStatus: http.StatusBadRequest,
+			expBody: `{"error":"partial write: unable to parse 2 lines: line 1: malformed: expected fields: \"cpu,host=serverA\""}` + "\n",
+		},
+		"accepted":   {body, nil, 0, http.StatusNoContent, ""},
+		"queue full": {body, ErrIngressQueueFull, 0, http.StatusServiceUnavailable, `{"error":"2 of 2 points rejected"}` + "\n"},
+		"partial":    {body, ErrIngressQueueFull, 1, http.StatusBadRequest, `{"error":"partial write: 1 of 2 points rejected"}` + "\n"},
+	}
+
+	for k, tc := range cases {
+		func() {
+			defer thInitRegistry()()
+
+			var samplesGot int
+			s := newServer(func(*sample) error {
+				samplesGot++
+				if samplesGot <= tc.rejectFrom {
+					return nil
+				}
+				return tc.handlerErr
+			}, 1024)
+
+			w := httptest.NewRecorder()
+			s.influxWriteHandler(1024, newInfluxFormat(nil))(w, httptest.NewRequest(http.MethodPost, "/write", strings.NewReader(tc.body)))
+
+			a.Equal(t, tc.expStatus, w.Code, k)
+			a.Equal(t, tc.expBody, w.Body.String(), k)
+		}()
+	}
+}
+
+func Test_Server_IngestHandler_Gzip(t *testing.T) {
+	defer thInitRegistry()()
+
+	rec := &thSampleRecorder{}
+	s := newServer(rec.handle, 1024)
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte("name_of_2_metric|g|56\n"))
+	gz.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/ingest", &buf)
+	r.Header.Set("Content-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	s.ingestHandler(1024, formatNative)(w, r)
+
+	a.Equal(t, http.StatusOK, w.Code)
+	a.Equal(t, []sample{{name: "name_of_2_metric", kind: sampleGauge, labels: map[string]string{}, value: 56}}, rec.samples)
+}
+
+func Test_Server_IngestHandler_InvalidElements(t *testing.T) {
+	defer thInitRegistry()()
+
+	rec := &thSampleRecorder{}
+	s := newServer(rec.handle, 1024)
+
+	body := `[{"name": "name_of_2_metric", "type": "g", "value": 56}, {"name": "name_of_2_metric", "type": "g"}]`
+	w := httptest.NewRecorder()
+	s.ingestHandler(1024, formatJSON)(w, httptest.NewRequest(http.MethodPost, "/ingest", strings.NewReader(body)))
+
+	a.Equal(t, http.StatusOK, w.Code)
+	a.Equal(t, `{"accepted":1,"rejected":0,"errors":[{"index":1,"reason":"bad_value","error":"missing value"}]}`+"\n", w.Body.String())
+	a.Len(t, rec.samples, 1)
+}
+
+func Test_Server_ReportParseErrors(t *testing.T) {
+	defer thInitRegistry()()
+
+	s := newServer(func(*sample) error { return nil }, 1024)
+	s.handlePacket([]byte("name_of_1_metric_total|x|1\nname_of_1_metric_total|c|abc\nname_of_1_metric_total|c|def\n"), transportUDP, formatNative)
+	s.handlePacket([]byte("[{"), transportUDP, formatJSON)
+
+	exp := map[string]float64{"bad_kind": 1, "bad_value": 2, "malformed": 1}
+	for reason, v := range exp {
+		var mm dto.Metric
+		s.metricParseErrorsTotal.WithLabelValues(reason).Write(&mm)
+		a.Equal(t, v, mm.Counter.GetValue(), reason)
+	}
+}
+
+func Test_Server_HandlePacket_ReservedLabels(t *testing.T) {
+	defer thInitRegistry()()
+
+	f, err := newDogStatsDFormat(dogStatsDBareTagDrop)
+	if !a.NoError(t, err) {
+		return
+	}
+	body := "lat:5|h|#le:1\nlat:5|h|#env:prod\nlat:5|g|#le:1\n"
+
+	rec := &thSampleRecorder{}
+	s := newServer(rec.handle, 1024)
+	s.handlePacket([]byte(body), transportUDP, f)
+
+	w := httptest.NewRecorder()
+	s.ingestHandler(1024, f)(w, httptest.NewRequest(http.MethodPost, "/ingest", strings.NewReader(body)))
+	a.Equal(t, `{"accepted":2,"rejected":0}`+"\n", w.Body.String())
+
+	// histogram with "le" label would make collector panic
+	if a.Len(t, rec.samples, 4) {
+		for _, s := range rec.samples {
+			a.False(t, s.kind == sampleHistogram && s.labels["le"] != "", s.name)
+		}
+	}
+
+	var mm dto.Metric
+	s.metricParseErrorsTotal.WithLabelValues(string(parseErrorBadLabel)).Write(&mm)
+	a.Equal(t, float64(2), mm.Counter.GetValue())
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// ListenUnixgram starts server reading samples from Unix domain datagram socket.
+//
+// Socket file is created at path with mode permissions. Stale socket left at path
+// (e.g. after crash) is removed before binding. Path used by an active socket
+// or by a file of other type results in error.
+// Datagrams are parsed according to format.
+func (s *server) ListenUnixgram(path string, mode os.FileMode, format *sampleFormat) error {
+	if err := removeStaleSocket(path); err != nil {
+		return err
+	}
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return errors.Wrap(err, "opening server socket failed")
+	}
+
+	if err := os.Chmod(path, mode); err != nil {
+		conn.Close()
+		return errors.Wrap(err, "setting socket permissions failed")
+	}
+
+	go s.serveDatagrams(conn, transportUnixgram, "0", format)
+
+	return nil
+}
+
+// removeStaleSocket removes socket file at path, if no one is listening on it.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "checking socket path failed")
+	}
+
+	if fi.Mode()&os.ModeSocket == 0 {
+		return errors.Errorf("path %s exists and is not a socket", path)
+	}
+
+	// connecting to datagram socket succeeds only when someone is bound to it
+	if conn, err := net.Dial("unixgram", path); err == nil {
+		conn.Close()
+		return errors.Errorf("socket %s is in use", path)
+	}
+
+	if err := os.Remove(path); err != nil {
+		return errors.Wrap(err, "removing stale socket failed")
+	}
+
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"hash/maphash"
+	"math"
+	"math/bits"
+)
+
+const (
+	// setExactLimit is a number of distinct tokens counted exactly by uniqueSet.
+	// Tokens beyond it are counted approximately.
+	setExactLimit = 1024
+
+	// setPrecision is a number of hash bits used to pick HyperLogLog register.
+	// 2^14 registers take 16KiB and give standard error of about 0.8%.
+	setPrecision = 14
+
+	setRegisters = 1 << setPrecision
+)
+
+// setHashSeed is used for hashing tokens of all sets, so they are comparable within the process.
+var setHashSeed = maphash.MakeSeed()
+
+// uniqueSet counts distinct tokens.
+//
+// Hashes of tokens are kept exactly up to setExactLimit. Beyond it tokens are counted with HyperLogLog,
+// so memory used by single set is bounded. It's not safe for concurrent use.
+type uniqueSet struct {
+	exact map[uint64]struct{}
+
+	// registers hold HyperLogLog state, they are used only when approx is set
+	registers []uint8
+	approx    bool
+}
+
+func newUniqueSet() *uniqueSet {
+	return &uniqueSet{exact: make(map[uint64]struct{})}
+}
+
+// add adds token to the set.
+func (u *uniqueSet) add(token string) {
+	h := maphash.String(setHashSeed, token)
+	if u.approx {
+		u.addRegister(h)
+		return
+	}
+
+	u.exact[h] = struct{}{}
+	if len(u.exact) <= setExactLimit {
+		return
+	}
+
+	// switch to HyperLogLog
+	if u.registers == nil {
+		u.registers = make([]uint8, setRegisters)
+	}
+	for h := range u.exact {
+		u.addRegister(h)
+	}
+	clear(u.exact)
+	u.approx = true
+}
+
+// addRegister updates register picked by top bits of hash h with position of the first set bit in the rest.
+func (u *uniqueSet) addRegister(h uint64) {
+	i := h >> (64 - setPrecision)
+	rank := uint8(bits.LeadingZeros64(h<<setPrecision|1<<(setPrecision-1))) + 1
+	if rank > u.registers[i] {
+		u.registers[i] = rank
+	}
+}
+
+// count returns number of distinct tokens in the set, exact or estimated.
+func (u *uniqueSet) count() uint64 {
+	if !u.approx {
+		return uint64(len(u.exact))
+	}
+
+	var (
+		sum   float64
+		zeros int
+	)
+	for _, r := range u.registers {
+		sum += 1 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	m := float64(setRegisters)
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		// linear counting is more accurate for small cardinalities
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(estimate + 0.5)
+}
+
+// reset removes all tokens from the set. Memory is kept for reuse.
+func (u *uniqueSet) reset() {
+	clear(u.exact)
+	if u.approx {
+		clear(u.registers)
+		u.approx = false
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+
+	a "github.com/stretchr/testify/assert"
+)
+
+func Test_UniqueSet_Count_Exact(t *testing.T) {
+	u := newUniqueSet()
+	for i := 0; i < 3; i++ {
+		for j := 0; j < setExactLimit; j++ {
+			u.add(strconv.Itoa(j))
+		}
+	}
+
+	a.False(t, u.approx)
+	a.Equal(t, uint64(setExactLimit), u.count())
+}
+
+func Test_UniqueSet_Count_Approx(t *testing.T) {
+	cases := map[string]int{
+		"just above exact limit": setExactLimit + 1,
+		"10k":                    10000,
+		"1M":                     1000000,
+	}
+
+	for k, n := range cases {
+		u := newUniqueSet()
+		for i := 0; i < n; i++ {
+			u.add("user-" + strconv.Itoa(i))
+			// repeated tokens are not counted
+			u.add("user-0")
+		}
+
+		a.True(t, u.approx, k)
+		a.InEpsilon(t, n, u.count(), 0.03, k)
+		a.Len(t, u.registers, setRegisters, k)
+	}
+}
+
+func Test_UniqueSet_Reset(t *testing.T) {
+	u := newUniqueSet()
+	for i := 0; i < 2*setExactLimit; i++ {
+		u.add(strconv.Itoa(i))
+	}
+	u.reset()
+
+	a.False(t, u.approx)
+	a.Equal(t, uint64(0), u.count())
+
+	u.add("a")
+	u.add("b")
+	a.Equal(t, uint64(2), u.count())
+}
+
+func Benchmark_UniqueSet_Add(b *testing.B) {
+	tokens := make([]string, 4*setExactLimit)
+	for i := range tokens {
+		tokens[i] = "user-" + strconv.Itoa(i)
+	}
+	u := newUniqueSet()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		u.add(tokens[i%len(tokens)])
+	}
+}